@@ -1,7 +1,8 @@
 package main
 
 import (
-	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/server"
+	"flag"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/cli"
 	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/utils"
 	log "github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
@@ -14,14 +15,6 @@ import (
 func init() {
 
 	log.SetLevel(log.InfoLevel)
-	customLevel := os.Getenv("WEBHOOK_LOG_LEVEL")
-	if customLevel != "" {
-		level, err := log.ParseLevel(customLevel)
-		if err != nil {
-			log.Fatalf("Could not use level %s: %s", customLevel, err.Error())
-		}
-		log.SetLevel(level)
-	}
 
 	logFormatter := &prefixed.TextFormatter{
 		DisableColors:   true,
@@ -44,26 +37,10 @@ func init() {
 }
 
 func main() {
-	server.Run()
+	if err := cli.Run(os.Args[1:], os.Stdout); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(2)
+		}
+		log.Fatal(err.Error())
+	}
 }
-
-/* Send open alert to alertmanager
-curl -i 'http://localhost:9093/api/v2/alerts' \
--H 'accept: application/json' \
--H 'Content-Type: application/json' \
--d '[  {
-    "startsAt": "2021-04-01T12:49:45.720Z",
-    "annotations": {
-      "annotation_01": "annotation 01",
-      "annotation_02": "annotation 02",
-      "annotation_02": "annotation 03"
-    },
-    "labels": {
-      "alertname": "Test Alert",
-      "cluster": "Cluster 01",
-      "service": "Service 01"
-    },
-    "generatorURL": "http://openshift.com"
-  }
-]'
-*/
@@ -0,0 +1,152 @@
+package apiv2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Client covers the Dynatrace API v2 endpoints that are not available in dynatrace-go-client
+type Client struct {
+	baseURL    string
+	token      string
+	retries    int
+	retryTime  time.Duration
+	httpClient *http.Client
+}
+
+func New(cfg *config.Config) *Client {
+	return &Client{
+		baseURL:    cfg.Dynatrace.APIURL,
+		token:      cfg.Dynatrace.APIToken,
+		retries:    cfg.Dynatrace.Retries,
+		retryTime:  cfg.Dynatrace.RetryTime,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// StatusError is returned when the API answers with an error status code
+type StatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s returned %d: %s", e.Method, e.Path, e.StatusCode, e.Body)
+}
+
+type Entity struct {
+	EntityID    string `json:"entityId"`
+	DisplayName string `json:"displayName"`
+	Type        string `json:"type"`
+}
+
+type entitiesList struct {
+	Entities    []Entity `json:"entities"`
+	NextPageKey string   `json:"nextPageKey"`
+}
+
+// ListEntities returns all the entities matching the entity selector, ie: type(HOST),entityName("my-host")
+func (c *Client) ListEntities(selector string) ([]Entity, error) {
+	var entities []Entity
+
+	query := url.Values{"entitySelector": {selector}, "pageSize": {"500"}}
+	for {
+		var page entitiesList
+		if err := c.do(http.MethodGet, "/api/v2/entities", query, nil, &page); err != nil {
+			return nil, err
+		}
+		entities = append(entities, page.Entities...)
+		if page.NextPageKey == "" {
+			return entities, nil
+		}
+		// The next page key already carries the original query parameters
+		query = url.Values{"nextPageKey": {page.NextPageKey}}
+	}
+}
+
+// Ping checks that the API is reachable and accepts the token, with a single request listing at most one entity
+// The token only needs the entities.read scope for entity selectors: a 403, the token is valid but lacks the scope, is reachable
+// It is not retried, so that health checks fail fast
+func (c *Client) Ping() error {
+	query := url.Values{"entitySelector": {`type("CUSTOM_DEVICE")`}, "pageSize": {"1"}}
+	_, err := c.attempt(http.MethodGet, fmt.Sprintf("%s/api/v2/entities?%s", c.baseURL, query.Encode()), nil, nil)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusForbidden {
+		return nil
+	}
+	return err
+}
+
+// do sends a request to the API, retrying on connection errors, throttling and server errors
+// The payload, if not nil, is sent as JSON and the JSON response is decoded into result, if it is not nil
+func (c *Client) do(method string, path string, query url.Values, payload interface{}, result interface{}) (err error) {
+	start := time.Now()
+	defer func() { metrics.ObserveAPICall(path, start, err) }()
+	endpoint := fmt.Sprintf("%s%s", c.baseURL, path)
+	if len(query) > 0 {
+		endpoint = fmt.Sprintf("%s?%s", endpoint, query.Encode())
+	}
+
+	var body []byte
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(c.retryTime)
+		}
+
+		var retry bool
+		retry, err = c.attempt(method, endpoint, body, result)
+		if err == nil || !retry {
+			return err
+		}
+		log.WithFields(log.Fields{"method": method, "path": path, "attempt": attempt + 1, "error": err.Error()}).Warning("APIv2 - Request failed")
+	}
+	return err
+}
+
+func (c *Client) attempt(method string, endpoint string, body []byte, result interface{}) (bool, error) {
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Api-Token %s", c.token))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		content, _ := ioutil.ReadAll(resp.Body)
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, &StatusError{Method: method, Path: req.URL.Path, StatusCode: resp.StatusCode, Body: string(content)}
+	}
+
+	if result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return false, fmt.Errorf("could not decode the response of %s %s: %s", method, req.URL.Path, err.Error())
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,44 @@
+package apiv2
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// EventIngest is the payload of the Events API v2 ingest endpoint
+type EventIngest struct {
+	EventType      string            `json:"eventType"`
+	Title          string            `json:"title"`
+	StartTime      int64             `json:"startTime,omitempty"`
+	EndTime        int64             `json:"endTime,omitempty"`
+	Timeout        int               `json:"timeout,omitempty"`
+	EntitySelector string            `json:"entitySelector,omitempty"`
+	Properties     map[string]string `json:"properties,omitempty"`
+}
+
+type EventIngestResult struct {
+	CorrelationID string `json:"correlationId"`
+	Status        string `json:"status"`
+}
+
+type EventIngestResults struct {
+	ReportCount        int                 `json:"reportCount"`
+	EventIngestResults []EventIngestResult `json:"eventIngestResults"`
+}
+
+// IngestEvent sends an event to /api/v2/events/ingest, it fails if Dynatrace did not accept the event
+func (c *Client) IngestEvent(event EventIngest) (*EventIngestResults, error) {
+	var results EventIngestResults
+	if err := c.do(http.MethodPost, "/api/v2/events/ingest", nil, event, &results); err != nil {
+		return nil, err
+	}
+	for _, result := range results.EventIngestResults {
+		if result.Status != "OK" {
+			return &results, fmt.Errorf("dynatrace did not accept the event, status: %s", result.Status)
+		}
+	}
+	if len(results.EventIngestResults) == 0 {
+		return &results, fmt.Errorf("the event did not match any entity")
+	}
+	return &results, nil
+}
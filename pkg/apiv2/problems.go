@@ -0,0 +1,94 @@
+package apiv2
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type Problem struct {
+	ProblemID       string          `json:"problemId"`
+	DisplayID       string          `json:"displayId"`
+	Title           string          `json:"title"`
+	Status          string          `json:"status"`
+	EvidenceDetails EvidenceDetails `json:"evidenceDetails"`
+}
+
+type EvidenceDetails struct {
+	TotalCount int        `json:"totalCount"`
+	Details    []Evidence `json:"details"`
+}
+
+// Evidence is one piece of evidence of a problem, for events the event itself is in Data
+type Evidence struct {
+	EvidenceType string     `json:"evidenceType"`
+	DisplayName  string     `json:"displayName"`
+	Entity       EntityStub `json:"entity"`
+	EventID      string     `json:"eventId"`
+	EventType    string     `json:"eventType"`
+	Data         *Event     `json:"data"`
+}
+
+type EntityStub struct {
+	EntityID EntityID `json:"entityId"`
+	Name     string   `json:"name"`
+}
+
+type EntityID struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+type Event struct {
+	EventID       string          `json:"eventId"`
+	EventType     string          `json:"eventType"`
+	CorrelationID string          `json:"correlationId"`
+	Title         string          `json:"title"`
+	Properties    []EventProperty `json:"properties"`
+}
+
+type EventProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Property returns the value of an event property, and false if the event does not have it
+func (e *Event) Property(key string) (string, bool) {
+	for _, property := range e.Properties {
+		if property.Key == key {
+			return property.Value, true
+		}
+	}
+	return "", false
+}
+
+type problemsList struct {
+	Problems    []Problem `json:"problems"`
+	NextPageKey string    `json:"nextPageKey"`
+}
+
+// ListProblems returns the problems matching the problem selector, ie: status("open"),entityId("CUSTOM_DEVICE-1")
+// with their evidence details, for problems active after from
+func (c *Client) ListProblems(problemSelector string, from time.Time) ([]Problem, error) {
+	var problems []Problem
+
+	query := url.Values{
+		"problemSelector": {problemSelector},
+		"fields":          {"evidenceDetails"},
+		"from":            {strconv.FormatInt(from.UnixNano()/int64(time.Millisecond), 10)},
+		"pageSize":        {"500"},
+	}
+	for {
+		var page problemsList
+		if err := c.do(http.MethodGet, "/api/v2/problems", query, nil, &page); err != nil {
+			return nil, err
+		}
+		problems = append(problems, page.Problems...)
+		if page.NextPageKey == "" {
+			return problems, nil
+		}
+		// The next page key already carries the original query parameters
+		query = url.Values{"nextPageKey": {page.NextPageKey}}
+	}
+}
@@ -0,0 +1,243 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// boltSchemaVersion is the version of the layout of the database, it is stored in the meta bucket
+const boltSchemaVersion = 1
+
+var (
+	bucketProblems      = []byte("problems")
+	bucketCustomDevices = []byte("customDevices")
+	bucketMeta          = []byte("meta")
+
+	keySchemaVersion            = []byte("schemaVersion")
+	keyProblemsLastUpdated      = []byte("problemsLastUpdated")
+	keyCustomDevicesLastUpdated = []byte("customDevicesLastUpdated")
+)
+
+// boltStorage keeps the caches in a bbolt database, cache.db, with one bucket per cache
+// Problems are keyed by their hash and custom devices by their ID, the values are JSON
+type boltStorage struct {
+	db *bolt.DB
+}
+
+// openBoltStorage opens the database, creating it if needed
+// A new database imports the JSON caches found in the directory, which are then renamed to *.imported
+func openBoltStorage(directory string) (*boltStorage, error) {
+	location := path.Join(directory, "cache.db")
+	db, err := bolt.Open(location, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open the cache database %s: %s", location, err.Error())
+	}
+
+	legacy := newJSONStorage(directory)
+	var imported []string
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketProblems, bucketCustomDevices, bucketMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		meta := tx.Bucket(bucketMeta)
+		if version := meta.Get(keySchemaVersion); version != nil {
+			v, err := strconv.Atoi(string(version))
+			if err != nil || v > boltSchemaVersion {
+				return fmt.Errorf("unsupported schema version %s, the database was created by a newer version of the receiver", version)
+			}
+			return nil
+		}
+
+		imported, err = importJSON(tx, legacy)
+		if err != nil {
+			return err
+		}
+		return meta.Put(keySchemaVersion, []byte(strconv.Itoa(boltSchemaVersion)))
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not initialize the cache database %s: %s", location, err.Error())
+	}
+
+	for _, location := range imported {
+		if err := os.Rename(location, location+".imported"); err != nil {
+			log.WithFields(log.Fields{"location": location, "error": err.Error()}).Warning("Cache - Could not rename the imported cache file")
+		}
+	}
+
+	log.WithFields(log.Fields{"location": location}).Info("Cache - Opened the cache database")
+	return &boltStorage{db: db}, nil
+}
+
+// importJSON copies the JSON caches into the database, it returns the locations of the files that were imported
+func importJSON(tx *bolt.Tx, legacy *jsonStorage) ([]string, error) {
+	var imported []string
+
+	problemCache, err := legacy.loadProblems()
+	if err == nil {
+		if err := putProblems(tx, problemCache.Problems); err != nil {
+			return nil, err
+		}
+		imported = append(imported, legacy.problemsLocation)
+		log.WithFields(log.Fields{"location": legacy.problemsLocation, "problems": len(problemCache.Problems)}).Info("Cache - Imported the problem cache")
+	} else if !os.IsNotExist(err) {
+		log.WithFields(log.Fields{"location": legacy.problemsLocation, "error": err.Error()}).Warning("Cache - Could not import the problem cache")
+	}
+
+	customDeviceCache, err := legacy.loadCustomDevices()
+	if v1, ok := err.(*customDevicesV1Error); ok {
+		customDeviceCache, err = v1.withoutNames(), nil
+	}
+	if err == nil {
+		if err := saveCustomDevices(tx, *customDeviceCache); err != nil {
+			return nil, err
+		}
+		imported = append(imported, legacy.customDevicesLocation)
+		log.WithFields(log.Fields{"location": legacy.customDevicesLocation, "customDevices": len(customDeviceCache.CustomDevices)}).Info("Cache - Imported the custom device cache")
+	} else if !os.IsNotExist(err) {
+		log.WithFields(log.Fields{"location": legacy.customDevicesLocation, "error": err.Error()}).Warning("Cache - Could not import the custom device cache")
+	}
+
+	return imported, nil
+}
+
+func (s *boltStorage) loadProblems() (*ProblemCache, error) {
+	cache := ProblemCache{Problems: map[string]Problem{}}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cache.LastUpdated = getTime(tx, keyProblemsLastUpdated)
+		return tx.Bucket(bucketProblems).ForEach(func(k, v []byte) error {
+			var problem Problem
+			if err := json.Unmarshal(v, &problem); err != nil {
+				log.WithFields(log.Fields{"hash": string(k), "error": err.Error()}).Warning("Cache - Ignoring a problem that could not be parsed")
+				return nil
+			}
+			cache.Problems[string(k)] = problem
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &cache, nil
+}
+
+func (s *boltStorage) putProblems(problems map[string]Problem) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putProblems(tx, problems)
+	})
+}
+
+func putProblems(tx *bolt.Tx, problems map[string]Problem) error {
+	bucket := tx.Bucket(bucketProblems)
+	for hash, problem := range problems {
+		value, err := json.Marshal(problem)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(hash), value); err != nil {
+			return err
+		}
+	}
+	return putTime(tx, keyProblemsLastUpdated, time.Now())
+}
+
+func (s *boltStorage) deleteProblem(hash string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketProblems).Delete([]byte(hash)); err != nil {
+			return err
+		}
+		return putTime(tx, keyProblemsLastUpdated, time.Now())
+	})
+}
+
+func (s *boltStorage) loadCustomDevices() (*CustomDeviceCache, error) {
+	cache := CustomDeviceCache{CustomDevices: []CustomDevice{}}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cache.LastUpdated = getTime(tx, keyCustomDevicesLastUpdated)
+		return tx.Bucket(bucketCustomDevices).ForEach(func(k, v []byte) error {
+			var customDevice CustomDevice
+			if err := json.Unmarshal(v, &customDevice); err != nil {
+				log.WithFields(log.Fields{"id": string(k), "error": err.Error()}).Warning("Cache - Ignoring a custom device that could not be parsed")
+				return nil
+			}
+			cache.CustomDevices = append(cache.CustomDevices, customDevice)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &cache, nil
+}
+
+func (s *boltStorage) saveCustomDevices(cache CustomDeviceCache) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return saveCustomDevices(tx, cache)
+	})
+}
+
+func saveCustomDevices(tx *bolt.Tx, cache CustomDeviceCache) error {
+	// Recreate the bucket, the cache is replaced as a whole
+	if err := tx.DeleteBucket(bucketCustomDevices); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	bucket, err := tx.CreateBucket(bucketCustomDevices)
+	if err != nil {
+		return err
+	}
+	for _, customDevice := range cache.CustomDevices {
+		value, err := json.Marshal(customDevice)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(customDevice.ID), value); err != nil {
+			return err
+		}
+	}
+	return putTime(tx, keyCustomDevicesLastUpdated, time.Now())
+}
+
+func (s *boltStorage) replace(snapshot Snapshot) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		// Recreate the bucket, the problems missing from the snapshot are deleted
+		if err := tx.DeleteBucket(bucketProblems); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err := tx.CreateBucket(bucketProblems); err != nil {
+			return err
+		}
+		if err := putProblems(tx, snapshot.Problems.Problems); err != nil {
+			return err
+		}
+		return saveCustomDevices(tx, snapshot.CustomDevices)
+	})
+}
+
+func (s *boltStorage) Close() error {
+	return s.db.Close()
+}
+
+func getTime(tx *bolt.Tx, key []byte) time.Time {
+	var t time.Time
+	if value := tx.Bucket(bucketMeta).Get(key); value != nil {
+		_ = t.UnmarshalText(value)
+	}
+	return t
+}
+
+func putTime(tx *bolt.Tx, key []byte, t time.Time) error {
+	value, err := t.MarshalText()
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketMeta).Put(key, value)
+}
@@ -1,22 +1,21 @@
 package cache
 
 import (
-	"encoding/json"
-	"fmt"
 	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
-	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/utils"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dtclient"
 	dynatrace "github.com/dlopes7/dynatrace-go-client/api"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
 	"os"
 	"sync"
 	"time"
 )
 
+// CustomDeviceCacheService is the DeviceStore, backed by a Storage
 type CustomDeviceCacheService struct {
-	cache    CustomDeviceCache
-	lock     sync.Mutex
-	location string
+	lock      sync.Mutex
+	storage   Storage
+	groupName string
 }
 
 type CustomDevice struct {
@@ -44,90 +43,109 @@ func (c *CustomDeviceCache) GetIDs() []string {
 
 }
 
-func NewCustomDeviceCacheService() CustomDeviceCacheService {
-	cache := CustomDeviceCache{
-		CustomDevices: []CustomDevice{},
-		LastUpdated:   time.Now(),
-	}
+func NewCustomDeviceCacheService(cfg *config.Config, storage Storage) CustomDeviceCacheService {
 	return CustomDeviceCacheService{
-		location: fmt.Sprintf("%s/customDevices.json", utils.GetTempDir()),
-		cache:    cache,
+		storage:   storage,
+		groupName: cfg.Dynatrace.GroupName,
 	}
 }
 
-func (c *CustomDeviceCacheService) updateCacheFromV1(dtClient *dynatrace.Client) (*CustomDeviceCache, error) {
+func (c *CustomDeviceCacheService) updateCacheFromV1(dtClient dtclient.Client, cache CustomDeviceCacheV1) *CustomDeviceCache {
 	// Necessary because I've changed the format of the cache
 	// If we find a cache on the old format, convert it to the new one
-	var cache CustomDeviceCacheV1
-	jsonFile, err := os.Open(c.location)
-	if err != nil {
-		log.WithFields(log.Fields{"location": c.location, "error": err.Error()}).Warning("Could not update the cache")
-		return nil, err
-	}
-	defer jsonFile.Close()
-	byteValue, _ := ioutil.ReadAll(jsonFile)
-	err = json.Unmarshal(byteValue, &cache)
-	if err != nil {
-		log.WithFields(log.Fields{"location": c.location, "error": err.Error()}).Warning("Could not update the custom device cache file")
-		return nil, err
-	}
 	// create a CustomDeviceCache with the devices from the current cache
 	var customDevices []CustomDevice
 	for _, id := range cache.CustomDevices {
 		name := id
 		log.WithFields(log.Fields{"id": id}).Info("Attempting to update the custom device name")
 
-		entity, _, err := dtClient.Entities.Get(id)
+		entity, err := dtClient.GetEntity(id)
 		if err == nil {
 			name = entity.DisplayName
 			log.WithFields(log.Fields{"id": id, "name": name}).Info("Setting the custom device name")
 		}
-		customDevices = append(customDevices, CustomDevice{ID: id, Name: name, Group: os.Getenv("DT_GROUP_NAME")})
+		customDevices = append(customDevices, CustomDevice{ID: id, Name: name, Group: c.groupName})
 	}
 	return &CustomDeviceCache{
 		CustomDevices: customDevices,
-	}, nil
+	}
 
 }
 
-func (c *CustomDeviceCacheService) GetCache(dtClient *dynatrace.Client) *CustomDeviceCache {
-	var cache CustomDeviceCache
-	jsonFile, err := os.Open(c.location)
+func (c *CustomDeviceCacheService) GetCache(dtClient dtclient.Client) *CustomDeviceCache {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.getCache(dtClient)
+}
+
+// getCache reads the cache, the lock must be held
+func (c *CustomDeviceCacheService) getCache(dtClient dtclient.Client) *CustomDeviceCache {
+	cache, err := c.storage.loadCustomDevices()
+	if v1, ok := err.(*customDevicesV1Error); ok {
+		log.Warning("The custom device cache is in the old format, attempting to update")
+		cache = c.updateCacheFromV1(dtClient, v1.cache)
+		c.save(*cache)
+	} else if os.IsNotExist(err) {
+		log.Info("Could not find the custom device cache, will create a new one")
+		cache = &CustomDeviceCache{CustomDevices: []CustomDevice{}, LastUpdated: time.Now()}
+	} else if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Warning("Could not read the custom device cache, resetting the cache")
+		cache = &CustomDeviceCache{CustomDevices: []CustomDevice{}, LastUpdated: time.Now()}
+	}
+	return cache
+}
+
+// CountCustomDevices returns the number of Custom Devices in the storage, ie: for the metrics
+// Unlike GetCache, it doesn't convert a v1 cache, which needs to call Dynatrace and rewrites the cache
+func CountCustomDevices(storage Storage) int {
+	cache, err := storage.loadCustomDevices()
+	if v1, ok := err.(*customDevicesV1Error); ok {
+		return len(v1.cache.CustomDevices)
+	}
 	if err != nil {
-		log.WithFields(log.Fields{"location": c.location, "error": err.Error()}).Warning("Could not open custom device cache file, will create a new one")
-		cache = c.cache
-	} else {
-		defer jsonFile.Close()
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal(byteValue, &cache)
-		if err != nil {
-			log.WithFields(log.Fields{"location": c.location, "error": err.Error()}).Warning("Could not parse the custom device cache file, attempting to update")
-			updatedCache, err := c.updateCacheFromV1(dtClient)
-			if err != nil {
-				log.WithFields(log.Fields{"location": c.location, "error": err.Error()}).Warning("Could not update the custom device cache file, resetting the cache")
-				cache = c.cache
-			} else {
-				cache = *updatedCache
-				c.Update(cache)
-			}
-		}
+		return 0
 	}
-	return &cache
+	return len(cache.CustomDevices)
 }
 
 func (c *CustomDeviceCacheService) Update(cd CustomDeviceCache) {
 	c.lock.Lock()
-	c.cache = cd
-	c.cache.LastUpdated = time.Now()
-	file, _ := json.MarshalIndent(c.cache, "", " ")
-	_ = ioutil.WriteFile(c.location, file, 0644)
+	c.save(cd)
 	c.lock.Unlock()
 }
 
+func (c *CustomDeviceCacheService) AddCustomDevice(dtClient dtclient.Client, customDevice CustomDevice) {
+	c.ReplaceCustomDevice(dtClient, customDevice.ID, customDevice)
+}
+
+func (c *CustomDeviceCacheService) ReplaceCustomDevice(dtClient dtclient.Client, id string, customDevice CustomDevice) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cache := c.getCache(dtClient)
+	for i, existing := range cache.CustomDevices {
+		if existing.ID == id {
+			cache.CustomDevices[i] = customDevice
+			c.save(*cache)
+			return
+		}
+	}
+	cache.CustomDevices = append(cache.CustomDevices, customDevice)
+	c.save(*cache)
+}
+
+// save writes the cache, the lock must be held
+func (c *CustomDeviceCacheService) save(cd CustomDeviceCache) {
+	cd.LastUpdated = time.Now()
+	if err := c.storage.saveCustomDevices(cd); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Could not save the custom device cache")
+	}
+}
+
+// ProblemCacheService is the ProblemStore, backed by a Storage
 type ProblemCacheService struct {
-	cache    ProblemCache
-	lock     sync.Mutex
-	location string
+	lock    sync.Mutex
+	storage Storage
 }
 
 type ProblemCache struct {
@@ -136,40 +154,41 @@ type ProblemCache struct {
 }
 
 type Problem struct {
-	Event            dynatrace.EventCreation    `json:"event"`
-	Alert            alertmanager.Data          `json:"alert"`
-	CreatedAt        time.Time                  `json:"createdAt"`
+	Event     dynatrace.EventCreation `json:"event"`
+	Alert     alertmanager.Data       `json:"alert"`
+	CreatedAt time.Time               `json:"createdAt"`
+	// UpdatedAt is the last time a notification updated the problem, it is zero until the first update
+	UpdatedAt        time.Time                  `json:"updatedAt,omitempty"`
 	EventStoreResult dynatrace.EventStoreResult `json:"eventStoreResult"`
 	ProblemID        string                     `json:"problemID"`
+	// AlertStatus is the status of each alert of the group, "firing" or "resolved", by fingerprint
+	// It is empty for the problems cached by older versions, their alerts are the firing ones in Alert
+	AlertStatus map[string]string `json:"alertStatus,omitempty"`
 }
 
-func NewProblemCacheService() ProblemCacheService {
-	pc := ProblemCache{
-		Problems:    map[string]Problem{},
-		LastUpdated: time.Now(),
+// LastSeen returns the last time a notification created or updated the problem
+func (p Problem) LastSeen() time.Time {
+	if p.UpdatedAt.After(p.CreatedAt) {
+		return p.UpdatedAt
 	}
+	return p.CreatedAt
+}
+
+func NewProblemCacheService(storage Storage) ProblemCacheService {
 	return ProblemCacheService{
-		location: fmt.Sprintf("%s/problems.json", utils.GetTempDir()),
-		cache:    pc,
+		storage: storage,
 	}
 }
 
 func (p *ProblemCacheService) GetCache() *ProblemCache {
-	var cache ProblemCache
-	jsonFile, err := os.Open(p.location)
-	if err != nil {
-		log.WithFields(log.Fields{"location": p.location, "error": err.Error()}).Warning("Could not open problems cache file, will create a new one")
-		cache = p.cache
-	} else {
-		defer jsonFile.Close()
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal(byteValue, &cache)
-		if err != nil {
-			log.WithFields(log.Fields{"location": p.location, "error": err.Error()}).Warning("Could not parse the problem cache file, resetting the cache")
-			cache = p.cache
-		}
+	cache, err := p.storage.loadProblems()
+	if os.IsNotExist(err) {
+		cache = &ProblemCache{Problems: map[string]Problem{}, LastUpdated: time.Now()}
+	} else if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Warning("Could not read the problem cache, resetting the cache")
+		cache = &ProblemCache{Problems: map[string]Problem{}, LastUpdated: time.Now()}
 	}
-	return &cache
+	return cache
 }
 
 func (p *ProblemCacheService) Lock() {
@@ -182,31 +201,23 @@ func (p *ProblemCacheService) UnLock() {
 
 func (p *ProblemCacheService) AddProblem(hash string, problem Problem) {
 	p.lock.Lock()
-	cache := p.GetCache()
-	cache.Problems[hash] = problem
-	cache.LastUpdated = time.Now()
-	p.cache = *cache
-	p.persist()
+	p.persist(map[string]Problem{hash: problem})
 	p.lock.Unlock()
 }
 
 func (p *ProblemCacheService) Update(pc ProblemCache) {
-	for hash, problem := range pc.Problems {
-		p.cache.Problems[hash] = problem
-	}
-	p.cache.LastUpdated = time.Now()
-	p.persist()
+	p.persist(pc.Problems)
 }
 
-func (p *ProblemCacheService) persist() {
-	file, _ := json.MarshalIndent(p.cache, "", " ")
-	_ = ioutil.WriteFile(p.location, file, 0644)
-
+func (p *ProblemCacheService) persist(problems map[string]Problem) {
+	if err := p.storage.putProblems(problems); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("ProblemCacheService - Could not save the problem cache")
+	}
 }
 
 func (p *ProblemCacheService) Delete(hash string) {
 	log.WithFields(log.Fields{"hash": hash}).Info("ProblemCacheService - deleting the cache entry")
-	delete(p.cache.Problems, hash)
-	p.cache.LastUpdated = time.Now()
-	p.persist()
+	if err := p.storage.deleteProblem(hash); err != nil {
+		log.WithFields(log.Fields{"hash": hash, "error": err.Error()}).Error("ProblemCacheService - Could not delete the cache entry")
+	}
 }
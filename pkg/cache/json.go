@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// jsonStorage keeps each cache in a JSON file, problems.json and customDevices.json
+// The files are replaced atomically, by writing a temporary file and renaming it
+type jsonStorage struct {
+	problemsLocation      string
+	customDevicesLocation string
+}
+
+func newJSONStorage(directory string) *jsonStorage {
+	return &jsonStorage{
+		problemsLocation:      path.Join(directory, "problems.json"),
+		customDevicesLocation: path.Join(directory, "customDevices.json"),
+	}
+}
+
+func (s *jsonStorage) loadProblems() (*ProblemCache, error) {
+	cache := ProblemCache{}
+	if err := readJSON(s.problemsLocation, &cache); err != nil {
+		return nil, err
+	}
+	if cache.Problems == nil {
+		cache.Problems = map[string]Problem{}
+	}
+	return &cache, nil
+}
+
+func (s *jsonStorage) putProblems(problems map[string]Problem) error {
+	cache, err := s.loadProblems()
+	if os.IsNotExist(err) {
+		cache = &ProblemCache{Problems: map[string]Problem{}}
+	} else if err != nil {
+		// Never overwrite a cache we could not read, it would lose the problems it tracks
+		return err
+	}
+	for hash, problem := range problems {
+		cache.Problems[hash] = problem
+	}
+	cache.LastUpdated = time.Now()
+	return writeJSON(s.problemsLocation, cache)
+}
+
+func (s *jsonStorage) deleteProblem(hash string) error {
+	cache, err := s.loadProblems()
+	if err != nil {
+		return err
+	}
+	delete(cache.Problems, hash)
+	cache.LastUpdated = time.Now()
+	return writeJSON(s.problemsLocation, cache)
+}
+
+func (s *jsonStorage) loadCustomDevices() (*CustomDeviceCache, error) {
+	cache := CustomDeviceCache{}
+	err := readJSON(s.customDevicesLocation, &cache)
+	if err == nil {
+		if cache.CustomDevices == nil {
+			cache.CustomDevices = []CustomDevice{}
+		}
+		return &cache, nil
+	}
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Older versions stored a list of IDs instead of the devices
+	var cacheV1 CustomDeviceCacheV1
+	if errV1 := readJSON(s.customDevicesLocation, &cacheV1); errV1 == nil {
+		return nil, &customDevicesV1Error{cache: cacheV1}
+	}
+	return nil, err
+}
+
+func (s *jsonStorage) saveCustomDevices(cache CustomDeviceCache) error {
+	return writeJSON(s.customDevicesLocation, cache)
+}
+
+// replace writes both files before renaming them, a failure while writing leaves both caches untouched
+// The renames are not a single transaction, but a rename doesn't fail halfway like a write
+func (s *jsonStorage) replace(snapshot Snapshot) error {
+	problems := snapshot.Problems
+	problems.LastUpdated = time.Now()
+	customDevices := snapshot.CustomDevices
+	customDevices.LastUpdated = time.Now()
+
+	problemsTmp, err := writeTemp(s.problemsLocation, problems)
+	if err != nil {
+		return err
+	}
+	customDevicesTmp, err := writeTemp(s.customDevicesLocation, customDevices)
+	if err != nil {
+		os.Remove(problemsTmp)
+		return err
+	}
+	if err := os.Rename(problemsTmp, s.problemsLocation); err != nil {
+		os.Remove(problemsTmp)
+		os.Remove(customDevicesTmp)
+		return err
+	}
+	return os.Rename(customDevicesTmp, s.customDevicesLocation)
+}
+
+func (s *jsonStorage) Close() error {
+	return nil
+}
+
+func readJSON(location string, v interface{}) error {
+	content, err := ioutil.ReadFile(location)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("could not parse %s: %s", location, err.Error())
+	}
+	return nil
+}
+
+func writeJSON(location string, v interface{}) error {
+	tmpLocation, err := writeTemp(location, v)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpLocation, location)
+}
+
+// writeTemp writes v next to location, and returns the location of the temporary file to rename
+func writeTemp(location string, v interface{}) (string, error) {
+	content, err := json.MarshalIndent(v, "", " ")
+	if err != nil {
+		return "", err
+	}
+
+	tmpLocation := location + ".tmp"
+	file, err := os.OpenFile(tmpLocation, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return tmpLocation, nil
+}
@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// memoryStorage keeps the caches in memory only, they are lost when the receiver restarts
+// Useful for tests, and for ephemeral pods or read-only filesystems where the caches can't be persisted
+type memoryStorage struct {
+	lock          sync.Mutex
+	problems      ProblemCache
+	customDevices CustomDeviceCache
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		problems:      ProblemCache{Problems: map[string]Problem{}},
+		customDevices: CustomDeviceCache{CustomDevices: []CustomDevice{}},
+	}
+}
+
+func (s *memoryStorage) loadProblems() (*ProblemCache, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Return a copy, like the other storages, callers are free to modify it
+	cache := ProblemCache{Problems: map[string]Problem{}, LastUpdated: s.problems.LastUpdated}
+	for hash, problem := range s.problems.Problems {
+		cache.Problems[hash] = problem
+	}
+	return &cache, nil
+}
+
+func (s *memoryStorage) putProblems(problems map[string]Problem) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for hash, problem := range problems {
+		s.problems.Problems[hash] = problem
+	}
+	s.problems.LastUpdated = time.Now()
+	return nil
+}
+
+func (s *memoryStorage) deleteProblem(hash string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.problems.Problems, hash)
+	s.problems.LastUpdated = time.Now()
+	return nil
+}
+
+func (s *memoryStorage) loadCustomDevices() (*CustomDeviceCache, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cache := CustomDeviceCache{LastUpdated: s.customDevices.LastUpdated}
+	cache.CustomDevices = append([]CustomDevice{}, s.customDevices.CustomDevices...)
+	return &cache, nil
+}
+
+func (s *memoryStorage) saveCustomDevices(cache CustomDeviceCache) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.customDevices = CustomDeviceCache{
+		CustomDevices: append([]CustomDevice{}, cache.CustomDevices...),
+		LastUpdated:   cache.LastUpdated,
+	}
+	return nil
+}
+
+func (s *memoryStorage) replace(snapshot Snapshot) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.problems = ProblemCache{Problems: map[string]Problem{}, LastUpdated: time.Now()}
+	for hash, problem := range snapshot.Problems.Problems {
+		s.problems.Problems[hash] = problem
+	}
+	s.customDevices = CustomDeviceCache{
+		CustomDevices: append([]CustomDevice{}, snapshot.CustomDevices.CustomDevices...),
+		LastUpdated:   time.Now(),
+	}
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
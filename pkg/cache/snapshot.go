@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"os"
+	"time"
+)
+
+// Snapshot is a copy of both caches, independent of the storage backend
+// It is used to inspect the caches, and to move them from one backend to another
+type Snapshot struct {
+	Problems      ProblemCache      `json:"problemCache"`
+	CustomDevices CustomDeviceCache `json:"customDeviceCache"`
+}
+
+// Export reads both caches from the storage, missing caches are exported empty
+func Export(storage Storage) (Snapshot, error) {
+	snapshot := Snapshot{
+		Problems:      ProblemCache{Problems: map[string]Problem{}},
+		CustomDevices: CustomDeviceCache{CustomDevices: []CustomDevice{}},
+	}
+
+	problemCache, err := storage.loadProblems()
+	if err == nil {
+		snapshot.Problems = *problemCache
+	} else if !os.IsNotExist(err) {
+		return Snapshot{}, err
+	}
+
+	customDeviceCache, err := storage.loadCustomDevices()
+	if v1, ok := err.(*customDevicesV1Error); ok {
+		customDeviceCache, err = v1.withoutNames(), nil
+	}
+	if err == nil {
+		snapshot.CustomDevices = *customDeviceCache
+	} else if !os.IsNotExist(err) {
+		return Snapshot{}, err
+	}
+
+	return snapshot, nil
+}
+
+// Import replaces the content of both caches with the snapshot, the problems missing from the snapshot are deleted
+// A failed import leaves the caches as they were
+func Import(storage Storage, snapshot Snapshot) error {
+	if snapshot.Problems.Problems == nil {
+		snapshot.Problems.Problems = map[string]Problem{}
+	}
+	if snapshot.CustomDevices.CustomDevices == nil {
+		snapshot.CustomDevices.CustomDevices = []CustomDevice{}
+	}
+	return storage.replace(snapshot)
+}
+
+// Prune deletes the problems not created or updated since olderThan, it returns the keys of the deleted problems
+func Prune(storage Storage, olderThan time.Time) ([]string, error) {
+	snapshot, err := Export(storage)
+	if err != nil {
+		return nil, err
+	}
+	var pruned []string
+	for hash, problem := range snapshot.Problems.Problems {
+		if problem.LastSeen().Before(olderThan) {
+			if err := storage.deleteProblem(hash); err != nil {
+				return pruned, err
+			}
+			pruned = append(pruned, hash)
+		}
+	}
+	return pruned, nil
+}
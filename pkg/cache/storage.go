@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dtclient"
+)
+
+// ProblemStore tracks the events that opened problems in Dynatrace, keyed by the GroupKey hash or the alert fingerprint
+type ProblemStore interface {
+	GetCache() *ProblemCache
+	AddProblem(hash string, problem Problem)
+	// Update adds or replaces the problems of the cache, the problems missing from pc are kept
+	Update(pc ProblemCache)
+	Delete(hash string)
+	// Lock and UnLock guard read-modify-write sequences, AddProblem must not be called while holding the lock
+	Lock()
+	UnLock()
+}
+
+// DeviceStore tracks the Custom Devices created in Dynatrace
+type DeviceStore interface {
+	// GetCache needs the Dynatrace client to convert caches written by older versions
+	GetCache(dtClient dtclient.Client) *CustomDeviceCache
+	Update(cd CustomDeviceCache)
+	// AddCustomDevice adds the Custom Device, or replaces the one with the same ID, in a single read-modify-write
+	AddCustomDevice(dtClient dtclient.Client, customDevice CustomDevice)
+	// ReplaceCustomDevice replaces the Custom Device with the ID, ie: when its ID changed, in a single read-modify-write
+	ReplaceCustomDevice(dtClient dtclient.Client, id string, customDevice CustomDevice)
+}
+
+// Storage persists the problem and custom device caches, it is shared by the cache services
+// Every write is a single transaction, a crash never leaves a partially written cache behind
+type Storage interface {
+	loadProblems() (*ProblemCache, error)
+	// putProblems adds or replaces the problems, the other problems are kept
+	putProblems(problems map[string]Problem) error
+	deleteProblem(hash string) error
+	loadCustomDevices() (*CustomDeviceCache, error)
+	// saveCustomDevices replaces the whole custom device cache
+	saveCustomDevices(cache CustomDeviceCache) error
+	// replace replaces the content of both caches, the problems missing from snapshot are deleted
+	replace(snapshot Snapshot) error
+	Close() error
+}
+
+// OpenStorage opens the storage backend selected by cache.backend in cache.directory
+func OpenStorage(cfg *config.Config) (Storage, error) {
+	switch cfg.Cache.Backend {
+	case config.CacheBackendMemory:
+		return newMemoryStorage(), nil
+	case config.CacheBackendJSON:
+		return newJSONStorage(cfg.Cache.Directory), nil
+	case config.CacheBackendBolt:
+		return openBoltStorage(cfg.Cache.Directory)
+	}
+	return nil, fmt.Errorf("unknown cache backend %q", cfg.Cache.Backend)
+}
+
+// customDevicesV1Error is returned when the custom device cache is still in its first format, a list of IDs
+type customDevicesV1Error struct {
+	cache CustomDeviceCacheV1
+}
+
+func (e *customDevicesV1Error) Error() string {
+	return "the custom device cache is in the v1 format"
+}
+
+// withoutNames converts the v1 cache to the current format, the names are only informative, the IDs are enough to find the devices
+func (e *customDevicesV1Error) withoutNames() *CustomDeviceCache {
+	cache := &CustomDeviceCache{CustomDevices: []CustomDevice{}, LastUpdated: e.cache.LastUpdated}
+	for _, id := range e.cache.CustomDevices {
+		cache.CustomDevices = append(cache.CustomDevices, CustomDevice{ID: id, Name: id})
+	}
+	return cache
+}
@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBoltImportsJSON(t *testing.T) {
+	directory := t.TempDir()
+	legacy := newJSONStorage(directory)
+	assert.NoError(t, legacy.putProblems(map[string]Problem{"abc": {Alert: alertmanager.Data{GroupKey: "{}:{alertname=\"Test\"}"}, ProblemID: "P-1"}}))
+	assert.NoError(t, ioutil.WriteFile(legacy.customDevicesLocation, []byte(`{"customDevices": ["CUSTOM_DEVICE-1"]}`), 0644))
+
+	storage, err := openBoltStorage(directory)
+	assert.NoError(t, err)
+
+	problems, err := storage.loadProblems()
+	assert.NoError(t, err)
+	assert.Equal(t, "P-1", problems.Problems["abc"].ProblemID)
+
+	customDevices, err := storage.loadCustomDevices()
+	assert.NoError(t, err)
+	assert.Equal(t, []CustomDevice{{ID: "CUSTOM_DEVICE-1", Name: "CUSTOM_DEVICE-1"}}, customDevices.CustomDevices)
+
+	_, err = os.Stat(legacy.problemsLocation)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(legacy.problemsLocation + ".imported")
+	assert.NoError(t, err)
+
+	// The import only happens once
+	assert.NoError(t, storage.deleteProblem("abc"))
+	assert.NoError(t, storage.Close())
+	assert.NoError(t, os.Rename(legacy.problemsLocation+".imported", legacy.problemsLocation))
+	storage, err = openBoltStorage(directory)
+	assert.NoError(t, err)
+	problems, _ = storage.loadProblems()
+	assert.Empty(t, problems.Problems)
+	assert.NoError(t, storage.Close())
+}
+
+func TestBoltStorage(t *testing.T) {
+	directory := t.TempDir()
+	storage, err := openBoltStorage(directory)
+	assert.NoError(t, err)
+
+	problemCache := NewProblemCacheService(storage)
+	problemCache.AddProblem("a", Problem{ProblemID: "P-1"})
+	problemCache.AddProblem("b", Problem{})
+	problemCache.Update(ProblemCache{Problems: map[string]Problem{"b": {ProblemID: "P-2"}}})
+	problemCache.Delete("a")
+	assert.Equal(t, map[string]Problem{"b": {ProblemID: "P-2"}}, problemCache.GetCache().Problems)
+
+	assert.NoError(t, storage.saveCustomDevices(CustomDeviceCache{CustomDevices: []CustomDevice{{ID: "1"}, {ID: "2"}}}))
+	assert.NoError(t, storage.saveCustomDevices(CustomDeviceCache{CustomDevices: []CustomDevice{{ID: "3"}}}))
+	customDevices, err := storage.loadCustomDevices()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"3"}, customDevices.GetIDs())
+	assert.NoError(t, storage.Close())
+
+	// Databases written by a newer version are refused
+	db, _ := bolt.Open(path.Join(directory, "cache.db"), 0644, nil)
+	_ = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMeta).Put(keySchemaVersion, []byte("99"))
+	})
+	db.Close()
+	_, err = openBoltStorage(directory)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unsupported schema version 99")
+	}
+}
+
+func TestAddCustomDeviceConcurrently(t *testing.T) {
+	cfg := config.Default()
+	deviceCache := NewCustomDeviceCacheService(cfg, newJSONStorage(t.TempDir()))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			deviceCache.AddCustomDevice(nil, CustomDevice{ID: fmt.Sprintf("CUSTOM_DEVICE-%d", i), Name: fmt.Sprintf("device-%d", i)})
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, deviceCache.GetCache(nil).CustomDevices, 20)
+
+	// Adding a device again replaces it
+	deviceCache.AddCustomDevice(nil, CustomDevice{ID: "CUSTOM_DEVICE-1", Name: "renamed"})
+	deviceCache.ReplaceCustomDevice(nil, "CUSTOM_DEVICE-2", CustomDevice{ID: "CUSTOM_DEVICE-22", Name: "device-2"})
+	customDevices := deviceCache.GetCache(nil)
+	assert.Len(t, customDevices.CustomDevices, 20)
+	assert.Contains(t, customDevices.CustomDevices, CustomDevice{ID: "CUSTOM_DEVICE-1", Name: "renamed"})
+	assert.NotContains(t, customDevices.GetIDs(), "CUSTOM_DEVICE-2")
+}
+
+func TestCountCustomDevices(t *testing.T) {
+	storage := newJSONStorage(t.TempDir())
+	assert.Equal(t, 0, CountCustomDevices(storage))
+
+	// A v1 cache is counted without being converted
+	v1 := `{"customDevices": ["CUSTOM_DEVICE-1", "CUSTOM_DEVICE-2"]}`
+	assert.NoError(t, ioutil.WriteFile(storage.customDevicesLocation, []byte(v1), 0644))
+	assert.Equal(t, 2, CountCustomDevices(storage))
+	content, _ := ioutil.ReadFile(storage.customDevicesLocation)
+	assert.Equal(t, v1, string(content))
+
+	assert.NoError(t, storage.saveCustomDevices(CustomDeviceCache{CustomDevices: []CustomDevice{{ID: "CUSTOM_DEVICE-1"}}}))
+	assert.Equal(t, 1, CountCustomDevices(storage))
+}
+
+func TestJSONStorageUnreadable(t *testing.T) {
+	storage := newJSONStorage(t.TempDir())
+	assert.NoError(t, ioutil.WriteFile(storage.problemsLocation, []byte(`{"problems": {"abc": `), 0644))
+
+	// The unreadable cache is not replaced by one holding only the new problems
+	assert.Error(t, storage.putProblems(map[string]Problem{"def": {ProblemID: "P-1"}}))
+	content, _ := ioutil.ReadFile(storage.problemsLocation)
+	assert.Equal(t, `{"problems": {"abc": `, string(content))
+}
+
+func TestImportReplaces(t *testing.T) {
+	snapshot := Snapshot{
+		Problems:      ProblemCache{Problems: map[string]Problem{"new": {ProblemID: "P-1"}}},
+		CustomDevices: CustomDeviceCache{CustomDevices: []CustomDevice{{ID: "CUSTOM_DEVICE-1"}}},
+	}
+
+	jsonStorage := newJSONStorage(t.TempDir())
+	boltStorage, err := openBoltStorage(t.TempDir())
+	assert.NoError(t, err)
+	defer boltStorage.Close()
+
+	for _, storage := range []Storage{jsonStorage, boltStorage, newMemoryStorage()} {
+		assert.NoError(t, storage.putProblems(map[string]Problem{"stale": {}}))
+		assert.NoError(t, storage.saveCustomDevices(CustomDeviceCache{CustomDevices: []CustomDevice{{ID: "CUSTOM_DEVICE-2"}}}))
+		assert.NoError(t, Import(storage, snapshot))
+
+		imported, err := Export(storage)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]Problem{"new": {ProblemID: "P-1"}}, imported.Problems.Problems)
+		assert.Equal(t, []string{"CUSTOM_DEVICE-1"}, imported.CustomDevices.GetIDs())
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	source := newJSONStorage(t.TempDir())
+	old := time.Now().Add(-10 * 24 * time.Hour)
+	assert.NoError(t, source.putProblems(map[string]Problem{"old": {CreatedAt: old}, "new": {CreatedAt: time.Now(), ProblemID: "P-1"}}))
+	assert.NoError(t, ioutil.WriteFile(source.customDevicesLocation, []byte(`{"customDevices": ["CUSTOM_DEVICE-1"]}`), 0644))
+
+	snapshot, err := Export(source)
+	assert.NoError(t, err)
+	assert.Len(t, snapshot.Problems.Problems, 2)
+	assert.Equal(t, []string{"CUSTOM_DEVICE-1"}, snapshot.CustomDevices.GetIDs())
+
+	// Import replaces the content of the destination
+	destination := newMemoryStorage()
+	assert.NoError(t, destination.putProblems(map[string]Problem{"stale": {}}))
+	assert.NoError(t, Import(destination, snapshot))
+	imported, err := Export(destination)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"CUSTOM_DEVICE-1"}, imported.CustomDevices.GetIDs())
+	assert.Len(t, imported.Problems.Problems, 2)
+	assert.NotContains(t, imported.Problems.Problems, "stale")
+
+	pruned, err := Prune(destination, time.Now().Add(-5*24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"old"}, pruned)
+	problems, _ := destination.loadProblems()
+	assert.Equal(t, "P-1", problems.Problems["new"].ProblemID)
+	assert.Len(t, problems.Problems, 1)
+}
@@ -0,0 +1,286 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/cache"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/server"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: dynatrace-receiver [-config config.yml] [-tenant name] <command> [arguments]
+
+Commands:
+  serve                        Starts the webhook, the default command
+  validate-config              Validates the configuration and exits
+  device-id <group> <name>     Prints the IDs of the Custom Device group and of the Custom Device
+  send-test <payload.json>     Sends an Alertmanager notification to Dynatrace, like the webhook does
+  cache dump                   Prints the problem and Custom Device caches
+  cache export <file>          Writes the caches to a JSON file
+  cache import <file>          Replaces the caches with the content of a file written by cache export
+  cache prune [-older-than d]  Deletes the problems not updated for d from the cache (default jobs.retention)
+
+The cache commands use the configured cache backend, the json backend must not be modified while the webhook is running.
+With tenants, the cache commands need -tenant, send-test routes the notification like the webhook unless -tenant is set.
+`
+
+// Run executes the command line, args doesn't include the program name
+// The output of the commands is written to stdout, the logs are sent to stderr to keep it usable
+func Run(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("dynatrace-receiver", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("WEBHOOK_CONFIG"), "Path to the YAML configuration file")
+	tenant := flags.String("tenant", "", "Name of the tenant for the cache and send-test commands")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	command, args := "serve", flags.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	if command != "serve" {
+		log.SetOutput(os.Stderr)
+	}
+
+	switch command {
+	case "serve":
+		return serve(*configPath, args)
+	case "validate-config":
+		return validateConfig(*configPath, args, stdout)
+	case "device-id":
+		return deviceID(args, stdout)
+	case "send-test":
+		return sendTest(*configPath, *tenant, args, stdout)
+	case "cache":
+		return cacheCommand(*configPath, *tenant, args, stdout)
+	}
+	flags.Usage()
+	return fmt.Errorf("unknown command %q", command)
+}
+
+// loadConfig loads and validates the configuration, and applies its log level
+func loadConfig(configPath string) (*config.Config, error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %s", err.Error())
+	}
+	// The level has already been validated by config.Load
+	level, _ := log.ParseLevel(cfg.Webhook.LogLevel)
+	log.SetLevel(level)
+	return cfg, nil
+}
+
+// tenantConfig returns the configuration of a tenant, the name is optional if there are no tenants in the configuration
+func tenantConfig(cfg *config.Config, name string) (*config.Config, error) {
+	if name == "" && len(cfg.Tenants) == 0 {
+		name = config.DefaultTenantName
+	}
+	if !utils.StringInSlice(name, cfg.TenantNames()) {
+		return nil, fmt.Errorf("-tenant must be one of %s, got %q", strings.Join(cfg.TenantNames(), ", "), name)
+	}
+	return cfg.ForTenant(name), nil
+}
+
+func expectArgs(args []string, names ...string) error {
+	if len(args) != len(names) {
+		if len(names) == 0 {
+			return fmt.Errorf("unexpected arguments %v", args)
+		}
+		return fmt.Errorf("expected the arguments %v, got %v", names, args)
+	}
+	return nil
+}
+
+func serve(configPath string, args []string) error {
+	if err := expectArgs(args); err != nil {
+		return err
+	}
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	return server.Run(cfg)
+}
+
+func validateConfig(configPath string, args []string, stdout io.Writer) error {
+	if err := expectArgs(args); err != nil {
+		return err
+	}
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "The configuration is valid: %d route(s), %s cache in %s, events API %s, problems API %s\n",
+		len(cfg.Routes), cfg.Cache.Backend, cfg.Cache.Directory, cfg.Dynatrace.EventsAPI, cfg.Dynatrace.ProblemsAPI)
+	return nil
+}
+
+func deviceID(args []string, stdout io.Writer) error {
+	if err := expectArgs(args, "group", "name"); err != nil {
+		return err
+	}
+	groupID, customDeviceID := utils.GenerateGroupAndCustomDeviceID(args[0], args[1])
+	fmt.Fprintf(stdout, "%s\n%s\n", groupID, customDeviceID)
+	return nil
+}
+
+func sendTest(configPath string, tenant string, args []string, stdout io.Writer) error {
+	if err := expectArgs(args, "payload.json"); err != nil {
+		return err
+	}
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	data := alertmanager.Data{}
+	if err := json.Unmarshal(content, &data); err != nil {
+		return fmt.Errorf("could not parse %s: %s", args[0], err.Error())
+	}
+
+	// Wait for the tags, they are applied in the background
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Webhook.ShutdownTimeout)
+	defer cancel()
+	if err := server.SendAlertsOnce(ctx, cfg, data, tenant); err != nil {
+		return fmt.Errorf("could not send the alerts to Dynatrace: %s", err.Error())
+	}
+	fmt.Fprintf(stdout, "Sent the %s notification with %d alert(s) to Dynatrace\n", data.Status, len(data.Alerts))
+	return nil
+}
+
+func cacheCommand(configPath string, tenant string, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("expected a cache command: dump, export, import or prune")
+	}
+	command, args := args[0], args[1:]
+
+	// Parse the arguments before opening the storage, the bolt database is locked while it is open
+	// Without -older-than, the problems are pruned after jobs.retention like the DeleteOldEvents job, once the configuration is loaded
+	var olderThan time.Duration
+	olderThanSet := false
+	switch command {
+	case "dump":
+		if err := expectArgs(args); err != nil {
+			return err
+		}
+	case "export", "import":
+		if err := expectArgs(args, "file"); err != nil {
+			return err
+		}
+	case "prune":
+		flags := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+		flags.DurationVar(&olderThan, "older-than", 0, "Deletes the problems not updated for this duration (default jobs.retention)")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if err := expectArgs(flags.Args()); err != nil {
+			return err
+		}
+		flags.Visit(func(f *flag.Flag) { olderThanSet = olderThanSet || f.Name == "older-than" })
+	default:
+		return fmt.Errorf("unknown cache command %q, expected dump, export, import or prune", command)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	cfg, err = tenantConfig(cfg, tenant)
+	if err != nil {
+		return err
+	}
+	if !olderThanSet {
+		olderThan = cfg.Jobs.Retention
+	}
+	if cfg.Cache.Backend == config.CacheBackendMemory {
+		return errors.New("the memory cache backend is not persisted, there is nothing to manage")
+	}
+	storage, err := cache.OpenStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	switch command {
+	case "dump":
+		snapshot, err := cache.Export(storage)
+		if err != nil {
+			return err
+		}
+		return writeSnapshot(stdout, snapshot)
+
+	case "export":
+		snapshot, err := cache.Export(storage)
+		if err != nil {
+			return err
+		}
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		if err := writeSnapshot(f, snapshot); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Exported %d problem(s) and %d Custom Device(s) to %s\n", len(snapshot.Problems.Problems), len(snapshot.CustomDevices.CustomDevices), args[0])
+
+	case "import":
+		content, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		snapshot := cache.Snapshot{}
+		if err := json.Unmarshal(content, &snapshot); err != nil {
+			return fmt.Errorf("could not parse %s: %s", args[0], err.Error())
+		}
+		if snapshot.Problems.Problems == nil {
+			snapshot.Problems.Problems = map[string]cache.Problem{}
+		}
+		if err := cache.Import(storage, snapshot); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Imported %d problem(s) and %d Custom Device(s) from %s\n", len(snapshot.Problems.Problems), len(snapshot.CustomDevices.CustomDevices), args[0])
+
+	case "prune":
+		pruned, err := cache.Prune(storage, time.Now().Add(-olderThan))
+		if err != nil {
+			return err
+		}
+		sort.Strings(pruned)
+		for _, hash := range pruned {
+			fmt.Fprintln(stdout, hash)
+		}
+		fmt.Fprintf(stdout, "Pruned %d problem(s) older than %s\n", len(pruned), olderThan)
+	}
+	return nil
+}
+
+func writeSnapshot(w io.Writer, snapshot cache.Snapshot) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(snapshot)
+}
@@ -0,0 +1,133 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dtclient/fake"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a configuration using the fake Dynatrace environment and a JSON cache in a temporary directory
+func writeConfig(t *testing.T, dt *fake.Server) string {
+	directory := t.TempDir()
+	configPath := filepath.Join(directory, "config.yml")
+	content := fmt.Sprintf(`
+dynatrace:
+  apiURL: %s
+  apiToken: my-token
+  problemSeverities: [critical]
+  retries: 0
+cache:
+  directory: %s
+`, dt.URL, filepath.Join(directory, "cache"))
+	assert.NoError(t, ioutil.WriteFile(configPath, []byte(content), 0644))
+	return configPath
+}
+
+func run(t *testing.T, args ...string) (string, error) {
+	stdout := &bytes.Buffer{}
+	err := Run(args, stdout)
+	return stdout.String(), err
+}
+
+func TestDeviceID(t *testing.T) {
+	out, err := run(t, "device-id", "alertmanager", "alertmanager")
+	assert.NoError(t, err)
+	assert.Equal(t, "CUSTOM_DEVICE_GROUP-E1ABC2CBF8723322\nCUSTOM_DEVICE-EBFD2154C71FC3F7\n", out)
+
+	_, err = run(t, "device-id", "alertmanager")
+	assert.Error(t, err)
+	_, err = run(t, "unknown")
+	assert.Error(t, err)
+}
+
+func TestValidateConfig(t *testing.T) {
+	dt := fake.New("my-token")
+	defer dt.Close()
+	configPath := writeConfig(t, dt)
+
+	out, err := run(t, "-config", configPath, "validate-config")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "The configuration is valid")
+
+	assert.NoError(t, ioutil.WriteFile(configPath, []byte("dynatrace:\n  apiURL: not a url\n"), 0644))
+	_, err = run(t, "-config", configPath, "validate-config")
+	assert.Error(t, err)
+}
+
+func TestSendTestLeavesQueue(t *testing.T) {
+	dt := fake.New("my-token")
+	defer dt.Close()
+	configPath := writeConfig(t, dt)
+	content, _ := ioutil.ReadFile(configPath)
+	assert.NoError(t, ioutil.WriteFile(configPath, append(content, []byte("queue:\n  enabled: true\n")...), 0644))
+
+	// The queue log of a running webhook
+	queueLog := filepath.Join(filepath.Dir(configPath), "cache", "queue", "queue.log")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(queueLog), os.ModePerm))
+	assert.NoError(t, ioutil.WriteFile(queueLog, []byte("not compacted\n"), 0644))
+	before, err := os.Stat(queueLog)
+	assert.NoError(t, err)
+
+	payload := filepath.Join(t.TempDir(), "payload.json")
+	assert.NoError(t, ioutil.WriteFile(payload, []byte(`{"status": "firing", "groupKey": "test", "alerts": [{"status": "firing", "labels": {"alertname": "Test", "severity": "critical"}}]}`), 0644))
+	_, err = run(t, "-config", configPath, "send-test", payload)
+	assert.NoError(t, err)
+	assert.Len(t, dt.Events(), 1)
+
+	after, err := os.Stat(queueLog)
+	if assert.NoError(t, err) {
+		assert.True(t, os.SameFile(before, after))
+	}
+	content, _ = ioutil.ReadFile(queueLog)
+	assert.Equal(t, "not compacted\n", string(content))
+}
+
+func TestSendTestAndCache(t *testing.T) {
+	dt := fake.New("my-token")
+	defer dt.Close()
+	configPath := writeConfig(t, dt)
+
+	payload := filepath.Join(t.TempDir(), "payload.json")
+	assert.NoError(t, ioutil.WriteFile(payload, []byte(`{
+		"status": "firing",
+		"groupKey": "{}:{alertname=\"Test\"}",
+		"alerts": [{"status": "firing", "labels": {"alertname": "Test", "severity": "critical"}}]
+	}`), 0644))
+
+	out, err := run(t, "-config", configPath, "send-test", payload)
+	assert.NoError(t, err)
+	assert.Contains(t, out, "Sent the firing notification with 1 alert(s)")
+	assert.Len(t, dt.OpenProblems(), 1)
+
+	out, err = run(t, "-config", configPath, "cache", "dump")
+	assert.NoError(t, err)
+	assert.Contains(t, out, `"groupKey": "{}:{alertname=\"Test\"}"`)
+	assert.Contains(t, out, `"name": "Alertmanager Events"`)
+
+	export := filepath.Join(t.TempDir(), "export.json")
+	_, err = run(t, "-config", configPath, "cache", "export", export)
+	assert.NoError(t, err)
+
+	// Nothing is old enough to be pruned by default
+	out, err = run(t, "-config", configPath, "cache", "prune")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "Pruned 0 problem(s)")
+	out, err = run(t, "-config", configPath, "cache", "prune", "-older-than", "0s")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "Pruned 1 problem(s)")
+
+	out, err = run(t, "-config", configPath, "cache", "import", export)
+	assert.NoError(t, err)
+	assert.Contains(t, out, "Imported 1 problem(s) and 1 Custom Device(s)")
+	out, _ = run(t, "-config", configPath, "cache", "dump")
+	assert.Equal(t, 1, strings.Count(out, `"groupKey"`))
+
+	_, err = run(t, "-config", configPath, "cache", "compact")
+	assert.Error(t, err)
+}
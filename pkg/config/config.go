@@ -0,0 +1,768 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/templates"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/utils"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DispatchModeGroup sends one event per Alertmanager notification, tracked by the groupKey
+	DispatchModeGroup = "group"
+	// DispatchModeAlert sends one event per alert of the notification, tracked by the alert fingerprint
+	DispatchModeAlert = "alert"
+)
+
+const (
+	CacheBackendJSON   = "json"
+	CacheBackendBolt   = "bolt"
+	CacheBackendMemory = "memory"
+)
+
+const (
+	APIVersion1 = "v1"
+	APIVersion2 = "v2"
+)
+
+const (
+	DefaultPort      = 9393
+	DefaultRetries   = 5
+	DefaultRetryTime = 2 * time.Second
+	// DefaultDedupWindow is shorter than the default repeat_interval of Alertmanager (4h) and longer than its delivery retries
+	DefaultDedupWindow = 5 * time.Minute
+	// DefaultShutdownTimeout fits in the default Kubernetes termination grace period of 30s
+	DefaultShutdownTimeout = 25 * time.Second
+
+	// DefaultTimeoutMinutes is the timeout of the events when the routes don't set one
+	DefaultTimeoutMinutes = 120
+	// DefaultRetention is how long the problems not updated by a notification stay in the cache
+	DefaultRetention = 5 * 24 * time.Hour
+
+	DefaultUpdateProblemIDsSchedule = "@every 2m"
+	DefaultResendEventsSchedule     = "@every 30m"
+	DefaultDeleteOldEventsSchedule  = "@every 1h"
+	DefaultReconcileSchedule        = "@every 10m"
+
+	DefaultQueueWorkers       = 4
+	DefaultQueueMaxRetries    = 5
+	DefaultQueueRetryInterval = 30 * time.Second
+)
+
+// Config is the full configuration of the receiver, usually loaded from a YAML file
+type Config struct {
+	Dynatrace Dynatrace `yaml:"dynatrace"`
+	Webhook   Webhook   `yaml:"webhook"`
+	Cache     Cache     `yaml:"cache"`
+	Queue     Queue     `yaml:"queue"`
+	Admin     Admin     `yaml:"admin"`
+	Jobs      Jobs      `yaml:"jobs"`
+	Templates Templates `yaml:"templates"`
+	// EventTypes maps the alerts to Dynatrace event types, routes with an eventType take precedence
+	EventTypes EventTypeMapping `yaml:"eventTypes"`
+	// Routes are evaluated in order for each alert, the first route whose matchers match the alert labels is used
+	// Alerts that don't match any route use the DefaultRoute
+	Routes       []Route `yaml:"routes"`
+	DefaultRoute Route   `yaml:"defaultRoute"`
+	// Tenants are separate Dynatrace environments, each with its own client, caches and jobs
+	// Without tenants, the dynatrace section is the only environment, named DefaultTenantName
+	Tenants []Tenant `yaml:"tenants"`
+	// DefaultTenant receives the notifications that are not routed to any tenant, they are rejected if it is empty
+	DefaultTenant string `yaml:"defaultTenant"`
+}
+
+// Tenant is a Dynatrace environment, the notifications are routed to it by the /webhook/{name} path,
+// by the name of the Alertmanager receiver, or by the common labels of the notification, in this order
+type Tenant struct {
+	Name string `yaml:"name"`
+	// APIURL, APIToken, APITokenFile and GroupName default to the values of the dynatrace section
+	APIURL       string `yaml:"apiURL"`
+	APIToken     string `yaml:"apiToken"`
+	APITokenFile string `yaml:"apiTokenFile"`
+	GroupName    string `yaml:"groupName"`
+	// Receivers are the names of the Alertmanager receivers sending to this tenant
+	Receivers []string `yaml:"receivers"`
+	// Matchers select the notifications by their common labels, tenants are evaluated in order
+	Matchers Matchers `yaml:"matchers"`
+}
+
+// DefaultTenantName is the name of the only tenant when no tenants are configured
+const DefaultTenantName = "default"
+
+var tenantNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+type Dynatrace struct {
+	// APIURL is the environment API URL, ie: https://abc12345.live.dynatrace.com
+	APIURL string `yaml:"apiURL"`
+	// APIToken can be set directly or read from APITokenFile, APITokenFile wins if both are set
+	APIToken     string `yaml:"apiToken"`
+	APITokenFile string `yaml:"apiTokenFile"`
+	GroupName    string `yaml:"groupName"`
+	// ProblemSeverities are the values of the severity label that open problems in Dynatrace
+	ProblemSeverities []string      `yaml:"problemSeverities"`
+	Retries           int           `yaml:"retries"`
+	RetryTime         time.Duration `yaml:"retryTime"`
+	// DispatchMode is either DispatchModeGroup (the default) or DispatchModeAlert
+	DispatchMode string `yaml:"dispatchMode"`
+	// EventsAPI selects the Events API version, APIVersion1 (the default) or APIVersion2
+	EventsAPI string `yaml:"eventsAPI"`
+	// ProblemsAPI selects the Problems API version used to find the problems opened by our events, APIVersion1 (the default) or APIVersion2
+	ProblemsAPI string `yaml:"problemsAPI"`
+	// DedupWindow is how long an identical notification is acknowledged without being sent again, 0 disables it
+	DedupWindow time.Duration `yaml:"dedupWindow"`
+}
+
+// Jobs configures the scheduled jobs, the schedules use the cron syntax, ie: "*/5 * * * *", or a descriptor, ie: "@every 2m"
+type Jobs struct {
+	UpdateProblemIDs string `yaml:"updateProblemIDs"`
+	// ResendEvents must run more often than the events time out, or the problems close between two runs
+	ResendEvents    string `yaml:"resendEvents"`
+	DeleteOldEvents string `yaml:"deleteOldEvents"`
+	Reconcile       string `yaml:"reconcile"`
+	// Retention is how long a problem stays in the cache without being updated by a notification
+	// It is also how far back the open problems are searched when a resolved group is missing from the cache
+	Retention time.Duration `yaml:"retention"`
+}
+
+type Webhook struct {
+	Port     int    `yaml:"port"`
+	LogLevel string `yaml:"logLevel"`
+	// ShutdownTimeout is how long the in-flight notifications, jobs and tags are waited for on SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	// Auth protects /webhook, Alertmanager sends the credentials configured in the http_config of the receiver
+	Auth WebhookAuth `yaml:"auth"`
+	// TLS serves every endpoint over HTTPS when CertFile and KeyFile are set
+	TLS TLS `yaml:"tls"`
+}
+
+// WebhookAuth is either a bearer token or basic auth, /webhook accepts any request if both are empty
+type WebhookAuth struct {
+	// BearerToken can be set directly or read from BearerTokenFile, BearerTokenFile wins if both are set
+	BearerToken     string    `yaml:"bearerToken"`
+	BearerTokenFile string    `yaml:"bearerTokenFile"`
+	BasicAuth       BasicAuth `yaml:"basicAuth"`
+}
+
+type BasicAuth struct {
+	Username string `yaml:"username"`
+	// Password can be set directly or read from PasswordFile, PasswordFile wins if both are set
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"passwordFile"`
+}
+
+// TLS configures HTTPS, the certificate and the key are reloaded when the files change (ie: renewed by cert-manager)
+type TLS struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// ClientCAFile enables mutual TLS, requests to /webhook must present a client certificate signed by one of these CAs
+	ClientCAFile string `yaml:"clientCAFile"`
+}
+
+// Enabled returns true if the webhook is served over HTTPS
+func (t TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// Templates are Go text/templates used to build the Dynatrace events, empty templates keep the default behavior
+// They are executed for each alert, see templates.Context for the available fields
+type Templates struct {
+	Title            string `yaml:"title"`
+	Description      string `yaml:"description"`
+	CustomDeviceName string `yaml:"customDeviceName"`
+}
+
+// EventTypeMapping maps the value of a label, the severity by default, to a Dynatrace event type
+// Values missing from the mapping open an ERROR_EVENT if they are in dynatrace.problemSeverities, otherwise they use the default
+type EventTypeMapping struct {
+	Label   string            `yaml:"label"`
+	Mapping map[string]string `yaml:"mapping"`
+	// Default is CUSTOM_INFO if empty
+	Default string `yaml:"default"`
+}
+
+// Route selects where and how the events of the matching alerts are sent to Dynatrace
+// Empty fields are inherited from the DefaultRoute
+type Route struct {
+	Name     string   `yaml:"name"`
+	Matchers Matchers `yaml:"matchers"`
+	// CustomDeviceName is a template, the default route falls back to templates.customDeviceName
+	CustomDeviceName string `yaml:"customDeviceName"`
+	// Group is the Custom Device group, the default route falls back to dynatrace.groupName
+	Group string `yaml:"group"`
+	// EntitySelector is a template rendering an entity selector, ie: type(CLOUD_APPLICATION_NAMESPACE),entityName("{{ .Labels.namespace }}")
+	// The event is attached to the matching entities, or to the Custom Device if nothing matches
+	EntitySelector string `yaml:"entitySelector"`
+	// EventType forces the Dynatrace event type, ie: AVAILABILITY_EVENT, instead of the one derived from the severity
+	EventType      string `yaml:"eventType"`
+	TimeoutMinutes int    `yaml:"timeoutMinutes"`
+	Tags           []Tag  `yaml:"tags"`
+}
+
+// Tag maps an alert to a Dynatrace tag applied to the Custom Device
+// The value comes from a label or a template, optionally translated with a lookup table
+// Tags without a value source are applied without a value, unless a default is set
+type Tag struct {
+	Key string `yaml:"key"`
+	// Label copies the value of an alert label
+	Label string `yaml:"label"`
+	// Value is a template, it can't be combined with Label
+	Value string `yaml:"value"`
+	// Lookup translates the value, values missing from the table use the default
+	Lookup map[string]string `yaml:"lookup"`
+	// Default is used when the value is empty or missing from the lookup table, the tag is skipped if it is empty too
+	Default string `yaml:"default"`
+	// Matchers are conditions on the alert labels, the tag is only applied if they all match
+	Matchers Matchers `yaml:"matchers"`
+}
+
+// EventTypes are the event types accepted by the Dynatrace Events API
+var EventTypes = []string{
+	"AVAILABILITY_EVENT",
+	"CUSTOM_ALERT",
+	"CUSTOM_ANNOTATION",
+	"CUSTOM_CONFIGURATION",
+	"CUSTOM_DEPLOYMENT",
+	"CUSTOM_INFO",
+	"ERROR_EVENT",
+	"MARKED_FOR_TERMINATION",
+	"PERFORMANCE_EVENT",
+	"RESOURCE_CONTENTION",
+}
+
+type Cache struct {
+	// Directory holds the cache files, it is created if it does not exist
+	Directory string `yaml:"directory"`
+	// Backend is either CacheBackendJSON (the default), problems.json and customDevices.json,
+	// CacheBackendBolt, a transactional cache.db database which imports the JSON files the first time it is opened,
+	// or CacheBackendMemory, which doesn't write anything to disk but loses the caches on restart
+	Backend string `yaml:"backend"`
+}
+
+// Admin is the REST API under /admin, used to inspect and operate on the caches
+// Requests must send the token as a bearer token: Authorization: Bearer <token>
+type Admin struct {
+	Enabled bool `yaml:"enabled"`
+	// Token can be set directly or read from TokenFile, TokenFile wins if both are set
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"tokenFile"`
+}
+
+// Queue persists the notifications on disk before answering Alertmanager, they are sent to Dynatrace in the background
+// Pending notifications are sent again after a restart
+type Queue struct {
+	Enabled bool `yaml:"enabled"`
+	// Directory holds the queue log, defaults to a queue folder in the cache directory
+	Directory string `yaml:"directory"`
+	// Workers send the notifications concurrently, notifications with the same groupKey are always sent in order by the same worker
+	Workers int `yaml:"workers"`
+	// MaxRetries is the number of times a notification is retried before being dropped
+	MaxRetries    int           `yaml:"maxRetries"`
+	RetryInterval time.Duration `yaml:"retryInterval"`
+}
+
+// Load reads the configuration from a YAML file, applies the environment variable overrides and validates the result
+// If path is empty, the configuration is built from the defaults and the environment variables only
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the configuration file %s: %s", path, err.Error())
+		}
+		if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+			return nil, fmt.Errorf("could not parse the configuration file %s: %s", path, err.Error())
+		}
+		log.WithFields(log.Fields{"path": path}).Info("Config - Loaded the configuration file")
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Default returns a configuration with every optional value filled in
+func Default() *Config {
+	return &Config{
+		Dynatrace: Dynatrace{
+			Retries:      DefaultRetries,
+			RetryTime:    DefaultRetryTime,
+			DispatchMode: DispatchModeGroup,
+			EventsAPI:    APIVersion1,
+			ProblemsAPI:  APIVersion1,
+			DedupWindow:  DefaultDedupWindow,
+		},
+		EventTypes: EventTypeMapping{
+			Label: "severity",
+		},
+		Webhook: Webhook{
+			Port:            DefaultPort,
+			LogLevel:        "info",
+			ShutdownTimeout: DefaultShutdownTimeout,
+		},
+		Cache: Cache{
+			Backend: CacheBackendJSON,
+		},
+		Jobs: Jobs{
+			UpdateProblemIDs: DefaultUpdateProblemIDsSchedule,
+			ResendEvents:     DefaultResendEventsSchedule,
+			DeleteOldEvents:  DefaultDeleteOldEventsSchedule,
+			Reconcile:        DefaultReconcileSchedule,
+			Retention:        DefaultRetention,
+		},
+		Queue: Queue{
+			Workers:       DefaultQueueWorkers,
+			MaxRetries:    DefaultQueueMaxRetries,
+			RetryInterval: DefaultQueueRetryInterval,
+		},
+	}
+}
+
+// applyEnv overrides the configuration with the environment variables the receiver has always supported
+func (c *Config) applyEnv() error {
+	if v := os.Getenv("DT_API_URL"); v != "" {
+		c.Dynatrace.APIURL = v
+	}
+	if v := os.Getenv("DT_API_TOKEN"); v != "" {
+		c.Dynatrace.APIToken = v
+	}
+	if v := os.Getenv("DT_GROUP_NAME"); v != "" {
+		c.Dynatrace.GroupName = v
+	}
+	if v := os.Getenv("WEBHOOK_PROBLEM_SEVERITIES"); v != "" {
+		c.Dynatrace.ProblemSeverities = strings.Split(v, ",")
+	}
+	if v := os.Getenv("WEBHOOK_PORT"); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("WEBHOOK_PORT must be a number, got %q", v)
+		}
+		c.Webhook.Port = port
+	}
+	if v := os.Getenv("WEBHOOK_LOG_LEVEL"); v != "" {
+		c.Webhook.LogLevel = v
+	}
+	if v := os.Getenv("WEBHOOK_LOG_FOLDER"); v != "" {
+		c.Cache.Directory = v
+	}
+	return nil
+}
+
+// validateAuth reads the secret files and checks the webhook authentication and TLS settings
+func (w *Webhook) validateAuth() error {
+	if w.Auth.BearerTokenFile != "" {
+		token, err := ioutil.ReadFile(w.Auth.BearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("webhook.auth.bearerTokenFile: could not read %s: %s", w.Auth.BearerTokenFile, err.Error())
+		}
+		w.Auth.BearerToken = strings.TrimSpace(string(token))
+	}
+
+	basicAuth := &w.Auth.BasicAuth
+	if basicAuth.PasswordFile != "" {
+		password, err := ioutil.ReadFile(basicAuth.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("webhook.auth.basicAuth.passwordFile: could not read %s: %s", basicAuth.PasswordFile, err.Error())
+		}
+		basicAuth.Password = strings.TrimSpace(string(password))
+	}
+	if (basicAuth.Username == "") != (basicAuth.Password == "") {
+		return fmt.Errorf("webhook.auth.basicAuth needs both a username and a password (or passwordFile)")
+	}
+	if basicAuth.Username != "" && w.Auth.BearerToken != "" {
+		return fmt.Errorf("webhook.auth: only one of bearerToken and basicAuth can be set")
+	}
+
+	if (w.TLS.CertFile == "") != (w.TLS.KeyFile == "") {
+		return fmt.Errorf("webhook.tls needs both a certFile and a keyFile")
+	}
+	if w.TLS.Enabled() {
+		if _, err := tls.LoadX509KeyPair(w.TLS.CertFile, w.TLS.KeyFile); err != nil {
+			return fmt.Errorf("webhook.tls: could not load the certificate: %s", err.Error())
+		}
+	}
+	if w.TLS.ClientCAFile != "" {
+		if !w.TLS.Enabled() {
+			return fmt.Errorf("webhook.tls.clientCAFile needs a certFile and a keyFile, client certificates are only sent over TLS")
+		}
+		if _, err := LoadCertPool(w.TLS.ClientCAFile); err != nil {
+			return fmt.Errorf("webhook.tls.clientCAFile: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// LoadCertPool reads the PEM encoded CA certificates of a file
+func LoadCertPool(location string) (*x509.CertPool, error) {
+	content, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", location, err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("%s does not contain any PEM encoded certificate", location)
+	}
+	return pool, nil
+}
+
+// Validate checks the configuration, returning an error describing the first problem found
+func (c *Config) Validate() error {
+	// With tenants, the connection of the dynatrace section is only a default for the tenants
+	if err := validateConnection("dynatrace", &c.Dynatrace.APIURL, &c.Dynatrace.APIToken, c.Dynatrace.APITokenFile, len(c.Tenants) > 0); err != nil {
+		return err
+	}
+
+	var severities []string
+	for _, severity := range c.Dynatrace.ProblemSeverities {
+		if severity = strings.TrimSpace(severity); severity != "" {
+			severities = append(severities, severity)
+		}
+	}
+	c.Dynatrace.ProblemSeverities = severities
+
+	if c.Dynatrace.Retries < 0 {
+		return fmt.Errorf("dynatrace.retries must not be negative, got %d", c.Dynatrace.Retries)
+	}
+	if c.Dynatrace.RetryTime < 0 {
+		return fmt.Errorf("dynatrace.retryTime must not be negative, got %s", c.Dynatrace.RetryTime)
+	}
+	if c.Dynatrace.DedupWindow < 0 {
+		return fmt.Errorf("dynatrace.dedupWindow must not be negative, got %s", c.Dynatrace.DedupWindow)
+	}
+
+	if c.Dynatrace.DispatchMode != DispatchModeGroup && c.Dynatrace.DispatchMode != DispatchModeAlert {
+		return fmt.Errorf("dynatrace.dispatchMode must be %q or %q, got %q", DispatchModeGroup, DispatchModeAlert, c.Dynatrace.DispatchMode)
+	}
+
+	if c.Dynatrace.EventsAPI != APIVersion1 && c.Dynatrace.EventsAPI != APIVersion2 {
+		return fmt.Errorf("dynatrace.eventsAPI must be %q or %q, got %q", APIVersion1, APIVersion2, c.Dynatrace.EventsAPI)
+	}
+
+	if c.Dynatrace.ProblemsAPI != APIVersion1 && c.Dynatrace.ProblemsAPI != APIVersion2 {
+		return fmt.Errorf("dynatrace.problemsAPI must be %q or %q, got %q", APIVersion1, APIVersion2, c.Dynatrace.ProblemsAPI)
+	}
+
+	if c.Webhook.Port < 1 || c.Webhook.Port > 65535 {
+		return fmt.Errorf("webhook.port must be between 1 and 65535, got %d", c.Webhook.Port)
+	}
+	if _, err := log.ParseLevel(c.Webhook.LogLevel); err != nil {
+		return fmt.Errorf("webhook.logLevel: %s", err.Error())
+	}
+
+	if c.Webhook.ShutdownTimeout <= 0 {
+		return fmt.Errorf("webhook.shutdownTimeout must be positive, got %s", c.Webhook.ShutdownTimeout)
+	}
+	if err := c.Webhook.validateAuth(); err != nil {
+		return err
+	}
+
+	if c.Admin.TokenFile != "" {
+		token, err := ioutil.ReadFile(c.Admin.TokenFile)
+		if err != nil {
+			return fmt.Errorf("admin.tokenFile: could not read %s: %s", c.Admin.TokenFile, err.Error())
+		}
+		c.Admin.Token = strings.TrimSpace(string(token))
+	}
+	if c.Admin.Enabled && c.Admin.Token == "" {
+		return fmt.Errorf("admin.token (or admin.tokenFile) is mandatory when the admin API is enabled")
+	}
+
+	templatesToCheck := map[string]string{
+		"templates.title":            c.Templates.Title,
+		"templates.description":      c.Templates.Description,
+		"templates.customDeviceName": c.Templates.CustomDeviceName,
+	}
+	for name, text := range templatesToCheck {
+		if _, err := templates.New(name, text); err != nil {
+			return err
+		}
+	}
+
+	if c.EventTypes.Label == "" {
+		return fmt.Errorf("eventTypes.label must not be empty")
+	}
+	for value, eventType := range c.EventTypes.Mapping {
+		if !utils.StringInSlice(eventType, EventTypes) {
+			return fmt.Errorf("eventTypes.mapping.%s: unknown event type %q, must be one of %s", value, eventType, strings.Join(EventTypes, ", "))
+		}
+	}
+	if c.EventTypes.Default != "" && !utils.StringInSlice(c.EventTypes.Default, EventTypes) {
+		return fmt.Errorf("eventTypes.default: unknown event type %q, must be one of %s", c.EventTypes.Default, strings.Join(EventTypes, ", "))
+	}
+
+	if err := c.DefaultRoute.validate("defaultRoute"); err != nil {
+		return err
+	}
+	if len(c.DefaultRoute.Matchers) > 0 {
+		return fmt.Errorf("defaultRoute: matchers are not allowed, the default route matches every alert")
+	}
+	for i, route := range c.Routes {
+		if err := route.validate(fmt.Sprintf("routes[%d]", i)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.validateJobs(); err != nil {
+		return err
+	}
+
+	if c.Cache.Backend != CacheBackendJSON && c.Cache.Backend != CacheBackendBolt && c.Cache.Backend != CacheBackendMemory {
+		return fmt.Errorf("cache.backend must be %q, %q or %q, got %q", CacheBackendJSON, CacheBackendBolt, CacheBackendMemory, c.Cache.Backend)
+	}
+
+	// The memory backend never writes to the cache directory, it may not exist or be on a read-only filesystem
+	if c.Cache.Backend != CacheBackendMemory {
+		if c.Cache.Directory == "" {
+			c.Cache.Directory = utils.GetTempDir()
+		} else if err := os.MkdirAll(c.Cache.Directory, os.ModePerm); err != nil {
+			return fmt.Errorf("cache.directory: could not create %s: %s", c.Cache.Directory, err.Error())
+		}
+	}
+
+	if c.Queue.Directory == "" && c.Cache.Directory != "" {
+		c.Queue.Directory = filepath.Join(c.Cache.Directory, "queue")
+	}
+	if c.Queue.Enabled && c.Queue.Directory == "" {
+		return fmt.Errorf("queue.directory is mandatory when cache.directory is not set with the %s cache backend", CacheBackendMemory)
+	}
+	if c.Queue.Workers < 1 {
+		return fmt.Errorf("queue.workers must be at least 1, got %d", c.Queue.Workers)
+	}
+	if c.Queue.MaxRetries < 0 {
+		return fmt.Errorf("queue.maxRetries must not be negative, got %d", c.Queue.MaxRetries)
+	}
+	if c.Queue.RetryInterval < 0 {
+		return fmt.Errorf("queue.retryInterval must not be negative, got %s", c.Queue.RetryInterval)
+	}
+
+	return c.validateTenants()
+}
+
+// validateConnection reads the token file and checks the API URL and token of a Dynatrace environment, section prefixes the errors
+// Empty values are only allowed if optional is true
+func validateConnection(section string, apiURL *string, apiToken *string, apiTokenFile string, optional bool) error {
+	// The dynatrace section can be set with environment variables
+	tokenHint, urlHint := "", ""
+	if section == "dynatrace" {
+		tokenHint, urlHint = " (or DT_API_TOKEN)", " (or DT_API_URL)"
+	}
+
+	if apiTokenFile != "" {
+		token, err := ioutil.ReadFile(apiTokenFile)
+		if err != nil {
+			return fmt.Errorf("%s.apiTokenFile: could not read %s: %s", section, apiTokenFile, err.Error())
+		}
+		*apiToken = strings.TrimSpace(string(token))
+	}
+	if *apiToken == "" && !optional {
+		return fmt.Errorf("%s.apiToken%s is mandatory", section, tokenHint)
+	}
+
+	if *apiURL == "" {
+		if optional {
+			return nil
+		}
+		return fmt.Errorf("%s.apiURL%s is mandatory", section, urlHint)
+	}
+	u, err := url.Parse(*apiURL)
+	if err != nil {
+		return fmt.Errorf("%s.apiURL %q is not a valid URL: %s", section, *apiURL, err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s.apiURL %q must be an absolute http(s) URL, ie: https://abc12345.live.dynatrace.com", section, *apiURL)
+	}
+	*apiURL = strings.TrimRight(*apiURL, "/")
+	return nil
+}
+
+// validateTenants checks the tenants and fills in the values they inherit from the dynatrace section
+func (c *Config) validateTenants() error {
+	names := map[string]bool{}
+	for i := range c.Tenants {
+		tenant := &c.Tenants[i]
+		section := fmt.Sprintf("tenants[%d]", i)
+		if !tenantNamePattern.MatchString(tenant.Name) {
+			return fmt.Errorf("%s.name %q must only contain letters, digits, - and _", section, tenant.Name)
+		}
+		if names[tenant.Name] {
+			return fmt.Errorf("%s.name: duplicate tenant %q", section, tenant.Name)
+		}
+		names[tenant.Name] = true
+		section = fmt.Sprintf("tenants[%s]", tenant.Name)
+
+		if tenant.APIToken == "" && tenant.APITokenFile == "" {
+			tenant.APIToken = c.Dynatrace.APIToken
+		}
+		if tenant.APIURL == "" {
+			tenant.APIURL = c.Dynatrace.APIURL
+		}
+		if tenant.GroupName == "" {
+			tenant.GroupName = c.Dynatrace.GroupName
+		}
+		if err := validateConnection(section, &tenant.APIURL, &tenant.APIToken, tenant.APITokenFile, false); err != nil {
+			return err
+		}
+
+		tenantConfig := c.ForTenant(tenant.Name)
+		if c.Cache.Backend != CacheBackendMemory {
+			if err := os.MkdirAll(tenantConfig.Cache.Directory, os.ModePerm); err != nil {
+				return fmt.Errorf("%s: could not create the cache directory %s: %s", section, tenantConfig.Cache.Directory, err.Error())
+			}
+		}
+	}
+
+	if c.DefaultTenant != "" && !names[c.DefaultTenant] {
+		return fmt.Errorf("defaultTenant: unknown tenant %q", c.DefaultTenant)
+	}
+	return nil
+}
+
+// TenantNames returns the names of the tenants, in order, or DefaultTenantName if there are no tenants
+func (c *Config) TenantNames() []string {
+	if len(c.Tenants) == 0 {
+		return []string{DefaultTenantName}
+	}
+	var names []string
+	for _, tenant := range c.Tenants {
+		names = append(names, tenant.Name)
+	}
+	return names
+}
+
+// ForTenant returns the configuration of a tenant: the Dynatrace connection of the tenant,
+// and cache and queue directories in sub-directories named after the tenant
+// Without tenants, the configuration is returned as is for DefaultTenantName
+func (c *Config) ForTenant(name string) *Config {
+	if len(c.Tenants) == 0 && name == DefaultTenantName {
+		return c
+	}
+
+	tenantConfig := *c
+	tenantConfig.Tenants = nil
+	tenantConfig.DefaultTenant = ""
+	for _, tenant := range c.Tenants {
+		if tenant.Name != name {
+			continue
+		}
+		tenantConfig.Dynatrace.APIURL = tenant.APIURL
+		tenantConfig.Dynatrace.APIToken = tenant.APIToken
+		tenantConfig.Dynatrace.APITokenFile = ""
+		tenantConfig.Dynatrace.GroupName = tenant.GroupName
+	}
+	if c.Cache.Directory != "" {
+		tenantConfig.Cache.Directory = filepath.Join(c.Cache.Directory, name)
+	}
+	if c.Queue.Directory != "" {
+		tenantConfig.Queue.Directory = filepath.Join(c.Queue.Directory, name)
+	}
+	return &tenantConfig
+}
+
+// validateJobs checks the schedules, and that the events don't time out between two runs of ResendEvents
+func (c *Config) validateJobs() error {
+	schedules := map[string]string{
+		"updateProblemIDs": c.Jobs.UpdateProblemIDs,
+		"resendEvents":     c.Jobs.ResendEvents,
+		"deleteOldEvents":  c.Jobs.DeleteOldEvents,
+		"reconcile":        c.Jobs.Reconcile,
+	}
+	for name, spec := range schedules {
+		if _, err := cron.ParseStandard(spec); err != nil {
+			return fmt.Errorf("jobs.%s: invalid schedule %q: %s", name, spec, err.Error())
+		}
+	}
+	if c.Jobs.Retention <= 0 {
+		return fmt.Errorf("jobs.retention must be greater than 0, got %s", c.Jobs.Retention)
+	}
+
+	resendSchedule, _ := cron.ParseStandard(c.Jobs.ResendEvents)
+	resendInterval := maxInterval(resendSchedule)
+	defaultTimeout := c.DefaultRoute.TimeoutMinutes
+	if defaultTimeout == 0 {
+		defaultTimeout = DefaultTimeoutMinutes
+	}
+	timeouts := map[string]int{"defaultRoute": defaultTimeout}
+	for i, route := range c.Routes {
+		if route.TimeoutMinutes != 0 {
+			name := fmt.Sprintf("routes[%d]", i)
+			if route.Name != "" {
+				name = fmt.Sprintf("%s (%s)", name, route.Name)
+			}
+			timeouts[name] = route.TimeoutMinutes
+		}
+	}
+	for name, timeout := range timeouts {
+		if resendInterval >= time.Duration(timeout)*time.Minute {
+			return fmt.Errorf("jobs.resendEvents runs every %s, the events of %s time out after %d minutes and would expire between two runs", resendInterval, name, timeout)
+		}
+	}
+	return nil
+}
+
+// maxInterval returns the longest time between two consecutive runs of the schedule, over its next runs
+func maxInterval(schedule cron.Schedule) time.Duration {
+	var longest time.Duration
+	previous := schedule.Next(time.Now())
+	// A week of runs covers the usual schedules, ie: hourly, daily or on weekdays
+	for end := previous.Add(7 * 24 * time.Hour); previous.Before(end); {
+		next := schedule.Next(previous)
+		if next.IsZero() {
+			break
+		}
+		if next.Sub(previous) > longest {
+			longest = next.Sub(previous)
+		}
+		previous = next
+	}
+	return longest
+}
+
+func (r *Route) validate(name string) error {
+	if r.Name != "" {
+		name = fmt.Sprintf("%s (%s)", name, r.Name)
+	}
+	if _, err := templates.New(name+".customDeviceName", r.CustomDeviceName); err != nil {
+		return err
+	}
+	if _, err := templates.New(name+".entitySelector", r.EntitySelector); err != nil {
+		return err
+	}
+	if r.EventType != "" && !utils.StringInSlice(r.EventType, EventTypes) {
+		return fmt.Errorf("%s.eventType: unknown event type %q, must be one of %s", name, r.EventType, strings.Join(EventTypes, ", "))
+	}
+	if r.TimeoutMinutes < 0 {
+		return fmt.Errorf("%s.timeoutMinutes must not be negative, got %d", name, r.TimeoutMinutes)
+	}
+	for i, tag := range r.Tags {
+		if tag.Key == "" {
+			return fmt.Errorf("%s.tags[%d].key is mandatory", name, i)
+		}
+		if tag.Label != "" && tag.Value != "" {
+			return fmt.Errorf("%s.tags[%d] (%s): label and value can't be used together", name, i, tag.Key)
+		}
+		if len(tag.Lookup) > 0 && tag.Label == "" && tag.Value == "" {
+			return fmt.Errorf("%s.tags[%d] (%s): lookup needs a label or a value to translate", name, i, tag.Key)
+		}
+		if _, err := templates.New(fmt.Sprintf("%s.tags[%d].value", name, i), tag.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"github.com/robfig/cron/v3"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	location := path.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(location, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func TestLoad(t *testing.T) {
+	location := writeConfig(t, `
+dynatrace:
+  apiURL: https://abc12345.live.dynatrace.com/
+  apiToken: my-token
+  groupName: Alertmanager OCP4
+  problemSeverities: [critical, " warning", ""]
+  retryTime: 5s
+webhook:
+  port: 8080
+cache:
+  directory: `+t.TempDir()+`
+`)
+
+	cfg, err := Load(location)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://abc12345.live.dynatrace.com", cfg.Dynatrace.APIURL)
+	assert.Equal(t, "my-token", cfg.Dynatrace.APIToken)
+	assert.Equal(t, "Alertmanager OCP4", cfg.Dynatrace.GroupName)
+	assert.Equal(t, []string{"critical", "warning"}, cfg.Dynatrace.ProblemSeverities)
+	assert.Equal(t, DefaultRetries, cfg.Dynatrace.Retries)
+	assert.Equal(t, 5*time.Second, cfg.Dynatrace.RetryTime)
+	assert.Equal(t, 8080, cfg.Webhook.Port)
+	assert.Equal(t, "info", cfg.Webhook.LogLevel)
+	assert.False(t, cfg.Queue.Enabled)
+	assert.Equal(t, path.Join(cfg.Cache.Directory, "queue"), cfg.Queue.Directory)
+	assert.Equal(t, DefaultResendEventsSchedule, cfg.Jobs.ResendEvents)
+	assert.Equal(t, DefaultRetention, cfg.Jobs.Retention)
+}
+
+func TestLoadEnvOverrides(t *testing.T) {
+	location := writeConfig(t, `
+dynatrace:
+  apiURL: https://abc12345.live.dynatrace.com
+  apiToken: my-token
+cache:
+  directory: `+t.TempDir()+`
+`)
+	os.Setenv("DT_API_TOKEN", "env-token")
+	os.Setenv("WEBHOOK_PROBLEM_SEVERITIES", "critical,error")
+	defer os.Unsetenv("DT_API_TOKEN")
+	defer os.Unsetenv("WEBHOOK_PROBLEM_SEVERITIES")
+
+	cfg, err := Load(location)
+	assert.NoError(t, err)
+	assert.Equal(t, "env-token", cfg.Dynatrace.APIToken)
+	assert.Equal(t, []string{"critical", "error"}, cfg.Dynatrace.ProblemSeverities)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	cases := map[string]string{
+		"dynatrace.apiToken":     "dynatrace:\n  apiURL: https://abc12345.live.dynatrace.com\n",
+		"dynatrace.apiURL":       "dynatrace:\n  apiToken: my-token\n  apiURL: abc12345.live.dynatrace.com\n",
+		"webhook.port":           "dynatrace:\n  apiToken: my-token\n  apiURL: https://abc12345.live.dynatrace.com\nwebhook:\n  port: 100000\n",
+		"dynatrace.dispatchMode": "dynatrace:\n  apiToken: my-token\n  apiURL: https://abc12345.live.dynatrace.com\n  dispatchMode: alerts\n",
+		"dynatrace.dedupWindow":  "dynatrace:\n  apiToken: my-token\n  apiURL: https://abc12345.live.dynatrace.com\n  dedupWindow: -1m\n",
+		"jobs.updateProblemIDs":  "dynatrace:\n  apiToken: my-token\n  apiURL: https://abc12345.live.dynatrace.com\njobs:\n  updateProblemIDs: every 2m\n",
+		"jobs.retention":         "dynatrace:\n  apiToken: my-token\n  apiURL: https://abc12345.live.dynatrace.com\njobs:\n  retention: -1h\n",
+		"defaultRoute time out":  "dynatrace:\n  apiToken: my-token\n  apiURL: https://abc12345.live.dynatrace.com\njobs:\n  resendEvents: \"@every 2h\"\n",
+		"routes[0] (fast) time":  "dynatrace:\n  apiToken: my-token\n  apiURL: https://abc12345.live.dynatrace.com\nroutes:\n  - name: fast\n    timeoutMinutes: 15\n",
+		"admin.token":            "dynatrace:\n  apiToken: my-token\n  apiURL: https://abc12345.live.dynatrace.com\nadmin:\n  enabled: true\n",
+		"webhook.auth.basicAuth": "dynatrace:\n  apiToken: my-token\n  apiURL: https://abc12345.live.dynatrace.com\nwebhook:\n  auth:\n    basicAuth:\n      username: alertmanager\n",
+		"webhook.tls":            "dynatrace:\n  apiToken: my-token\n  apiURL: https://abc12345.live.dynatrace.com\nwebhook:\n  tls:\n    certFile: tls.crt\n",
+		"tenants[prod].apiToken": "dynatrace:\n  apiURL: https://abc12345.live.dynatrace.com\ntenants:\n  - name: prod\n",
+		"duplicate tenant":       "dynatrace:\n  apiToken: my-token\n  apiURL: https://abc12345.live.dynatrace.com\ntenants:\n  - name: prod\n  - name: prod\n",
+		"defaultTenant":          "dynatrace:\n  apiToken: my-token\n  apiURL: https://abc12345.live.dynatrace.com\ntenants:\n  - name: prod\ndefaultTenant: dev\n",
+		"queue.workers":          "dynatrace:\n  apiToken: my-token\n  apiURL: https://abc12345.live.dynatrace.com\nqueue:\n  workers: 0\n",
+		"field apiUrl not found": "dynatrace:\n  apiToken: my-token\n  apiUrl: https://abc12345.live.dynatrace.com\n",
+	}
+	for expected, content := range cases {
+		_, err := Load(writeConfig(t, content))
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), expected)
+		}
+	}
+}
+
+func TestMaxInterval(t *testing.T) {
+	cases := map[string]time.Duration{
+		"@every 30m":      30 * time.Minute,
+		"0 * * * *":       time.Hour,
+		"0 8,20 * * *":    12 * time.Hour,
+		"0 9 * * MON-FRI": 72 * time.Hour,
+	}
+	for spec, expected := range cases {
+		schedule, err := cron.ParseStandard(spec)
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, maxInterval(schedule), spec)
+		}
+	}
+}
+
+func TestTenants(t *testing.T) {
+	directory := t.TempDir()
+	cfg, err := Load(writeConfig(t, `
+dynatrace:
+  apiToken: shared-token
+  groupName: Alertmanager
+cache:
+  directory: `+directory+`
+tenants:
+  - name: prod
+    apiURL: https://prod.live.dynatrace.com/
+  - name: non-prod
+    apiURL: https://non-prod.live.dynatrace.com
+    apiToken: non-prod-token
+    groupName: Alertmanager Non Prod
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"prod", "non-prod"}, cfg.TenantNames())
+
+	prod := cfg.ForTenant("prod")
+	assert.Equal(t, "https://prod.live.dynatrace.com", prod.Dynatrace.APIURL)
+	assert.Equal(t, "shared-token", prod.Dynatrace.APIToken)
+	assert.Equal(t, "Alertmanager", prod.Dynatrace.GroupName)
+	assert.Equal(t, filepath.Join(directory, "prod"), prod.Cache.Directory)
+	assert.Equal(t, filepath.Join(directory, "queue", "prod"), prod.Queue.Directory)
+	assert.DirExists(t, prod.Cache.Directory)
+
+	nonProd := cfg.ForTenant("non-prod")
+	assert.Equal(t, "non-prod-token", nonProd.Dynatrace.APIToken)
+	assert.Equal(t, "Alertmanager Non Prod", nonProd.Dynatrace.GroupName)
+
+	// Without tenants, the configuration is the only tenant
+	cfg, err = Load(writeConfig(t, "dynatrace:\n  apiToken: my-token\n  apiURL: https://abc12345.live.dynatrace.com\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{DefaultTenantName}, cfg.TenantNames())
+	assert.Same(t, cfg, cfg.ForTenant(DefaultTenantName))
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"fmt"
+	"github.com/prometheus/alertmanager/pkg/labels"
+	"github.com/prometheus/alertmanager/template"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var matcherRegexp = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*(.*?)\s*$`)
+
+var matchTypes = map[string]labels.MatchType{
+	"=":  labels.MatchEqual,
+	"!=": labels.MatchNotEqual,
+	"=~": labels.MatchRegexp,
+	"!~": labels.MatchNotRegexp,
+}
+
+// Matchers is a list of Alertmanager style label matchers, ie: ["severity=~critical|warning", "namespace!=\"kube-system\""]
+// All the matchers must match for the list to match
+type Matchers []*labels.Matcher
+
+// ParseMatcher parses a matcher in the name<operator>value format, the value can optionally be quoted
+func ParseMatcher(s string) (*labels.Matcher, error) {
+	parts := matcherRegexp.FindStringSubmatch(s)
+	if parts == nil {
+		return nil, fmt.Errorf("invalid matcher %q, expected name=value, name!=value, name=~regex or name!~regex", s)
+	}
+	name, operator, value := parts[1], parts[2], parts[3]
+
+	if strings.HasPrefix(value, `"`) {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid matcher %q, could not unquote the value: %s", s, err.Error())
+		}
+		value = unquoted
+	}
+
+	matcher, err := labels.NewMatcher(matchTypes[operator], name, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid matcher %q: %s", s, err.Error())
+	}
+	return matcher, nil
+}
+
+func (m *Matchers) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw []string
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	matchers := Matchers{}
+	for _, s := range raw {
+		matcher, err := ParseMatcher(s)
+		if err != nil {
+			return err
+		}
+		matchers = append(matchers, matcher)
+	}
+	*m = matchers
+	return nil
+}
+
+func (m Matchers) MarshalYAML() (interface{}, error) {
+	var raw []string
+	for _, matcher := range m {
+		raw = append(raw, matcher.String())
+	}
+	return raw, nil
+}
+
+// Matches returns true if all the matchers match the labels, a missing label is matched as an empty value
+func (m Matchers) Matches(kv template.KV) bool {
+	for _, matcher := range m {
+		if !matcher.Matches(kv[matcher.Name]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package dtclient
+
+import (
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/metrics"
+	dtapi "github.com/dlopes7/dynatrace-go-client/api"
+	"time"
+)
+
+// Client is the part of the Dynatrace API v1 used by the receiver
+// The Controller and the Scheduler only depend on this interface, New wraps the dynatrace-go-client
+type Client interface {
+	// CreateEvent sends an event with the Events API v1
+	CreateEvent(event dtapi.EventCreation) (*dtapi.EventStoreResult, error)
+	// CreateCustomDevice creates or updates a Custom Device, it returns the entity ID of the device
+	CreateCustomDevice(customDeviceID string, customDevice dtapi.CustomDevicePushMessage) (string, error)
+	// ListOpenProblems returns the open problems, with the correlation IDs of their events
+	ListOpenProblems() ([]Problem, error)
+	CloseProblem(problemID string, comment string) error
+	// CreateTags applies the tags to the entities matching the selector, it returns the number of matched entities
+	CreateTags(entitySelector string, tags []dtapi.Tag) (int, error)
+	GetEntity(entityID string) (*Entity, error)
+}
+
+// Problem is an open Dynatrace problem, as returned by the Problems API v1 feed
+type Problem struct {
+	ID             string
+	CorrelationIDs []string
+}
+
+type Entity struct {
+	EntityID    string
+	DisplayName string
+}
+
+type client struct {
+	dt dtapi.Client
+}
+
+// New returns a Client for the configured Dynatrace environment
+func New(cfg *config.Config) Client {
+	return &client{dt: dtapi.New(dtapi.Config{
+		APIKey:    cfg.Dynatrace.APIToken,
+		BaseURL:   cfg.Dynatrace.APIURL,
+		Retries:   cfg.Dynatrace.Retries,
+		RetryTime: cfg.Dynatrace.RetryTime,
+	})}
+}
+
+func (c *client) CreateEvent(event dtapi.EventCreation) (*dtapi.EventStoreResult, error) {
+	start := time.Now()
+	r, _, err := c.dt.Events.Create(event)
+	metrics.ObserveAPICall("/api/v1/events", start, err)
+	return r, err
+}
+
+func (c *client) CreateCustomDevice(customDeviceID string, customDevice dtapi.CustomDevicePushMessage) (string, error) {
+	start := time.Now()
+	r, _, err := c.dt.CustomDevice.Create(customDeviceID, customDevice)
+	metrics.ObserveAPICall("/api/v1/entity/infrastructure/custom/{id}", start, err)
+	if err != nil {
+		return "", err
+	}
+	return r.EntityID, nil
+}
+
+func (c *client) ListOpenProblems() ([]Problem, error) {
+	start := time.Now()
+	dtProblems, _, err := c.dt.Problem.ListV1("", 0, 0, "OPEN", "", "", nil, true)
+	metrics.ObserveAPICall("/api/v1/problem/feed", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	for _, dtProblem := range dtProblems {
+		problem := Problem{ID: dtProblem.ID}
+		for _, event := range dtProblem.RankedEvents {
+			problem.CorrelationIDs = append(problem.CorrelationIDs, event.CorrelationID)
+		}
+		problems = append(problems, problem)
+	}
+	return problems, nil
+}
+
+func (c *client) CloseProblem(problemID string, comment string) error {
+	start := time.Now()
+	_, err := c.dt.Problem.Close(problemID, comment)
+	metrics.ObserveAPICall("/api/v1/problem/details/{id}/close", start, err)
+	return err
+}
+
+func (c *client) CreateTags(entitySelector string, tags []dtapi.Tag) (int, error) {
+	start := time.Now()
+	r, _, err := c.dt.CustomTags.Create(entitySelector, tags)
+	metrics.ObserveAPICall("/api/v2/tags", start, err)
+	if err != nil {
+		return 0, err
+	}
+	if r == nil {
+		return 0, nil
+	}
+	return int(r.MatchedEntitiesCount), nil
+}
+
+func (c *client) GetEntity(entityID string) (*Entity, error) {
+	start := time.Now()
+	entity, _, err := c.dt.Entities.Get(entityID)
+	metrics.ObserveAPICall("/api/v2/entities/{id}", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &Entity{EntityID: entityID, DisplayName: entity.DisplayName}, nil
+}
@@ -0,0 +1,593 @@
+// Package fake is an in-memory Dynatrace environment served with httptest, for the tests of the receiver
+// It implements the parts of the Dynatrace API v1 and v2 used by the receiver
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/apiv2"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/utils"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a fake Dynatrace environment, it keeps the entities, events and problems in memory
+// Events of the types that open problems open a new problem, or are merged into the open problem of the same entity and title
+type Server struct {
+	*httptest.Server
+	Token string
+	// CorrelationDelay is the time it takes for a problem to show up in the problem APIs after its first event, like the real correlation
+	CorrelationDelay time.Duration
+	// Latency is added to every request, ie: to keep calls in flight
+	Latency time.Duration
+
+	lock     sync.Mutex
+	entities map[string]*Entity
+	events   []Event
+	problems []*Problem
+	failures []*failure
+	nextID   int
+}
+
+type Entity struct {
+	EntityID    string
+	DisplayName string
+	Type        string
+	Group       string
+	Tags        map[string]string
+}
+
+type Event struct {
+	CorrelationID string
+	EventType     string
+	Title         string
+	Description   string
+	EntityIDs     []string
+	Properties    map[string]string
+	// API is the version of the Events API used to send the event, v1 or v2
+	API string
+}
+
+type Problem struct {
+	ProblemID    string
+	Status       string
+	Title        string
+	Events       []Event
+	CreatedAt    time.Time
+	CloseComment string
+}
+
+type failure struct {
+	method string
+	prefix string
+	status int
+	times  int
+}
+
+// problemEventTypes are the event types that open problems, with both the v1 and v2 names
+var problemEventTypes = map[string]bool{
+	"AVAILABILITY_EVENT":        true,
+	"CUSTOM_ALERT":              true,
+	"ERROR_EVENT":               true,
+	"PERFORMANCE_EVENT":         true,
+	"RESOURCE_CONTENTION":       true,
+	"RESOURCE_CONTENTION_EVENT": true,
+}
+
+// New starts a fake Dynatrace environment accepting the token, it must be closed by the caller
+func New(token string) *Server {
+	s := &Server{
+		Token:    token,
+		entities: map[string]*Entity{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/events", s.createEventV1)
+	mux.HandleFunc("/api/v1/entity/infrastructure/custom/", s.createCustomDevice)
+	mux.HandleFunc("/api/v1/problem/feed", s.problemFeed)
+	mux.HandleFunc("/api/v1/problem/details/", s.closeProblem)
+	mux.HandleFunc("/api/v2/tags", s.createTags)
+	mux.HandleFunc("/api/v2/entities", s.listEntities)
+	mux.HandleFunc("/api/v2/entities/", s.getEntity)
+	mux.HandleFunc("/api/v2/events/ingest", s.ingestEvent)
+	mux.HandleFunc("/api/v2/problems", s.listProblems)
+	s.Server = httptest.NewServer(s.middleware(mux))
+	return s
+}
+
+// Fail makes the next requests with the method and a path starting with prefix fail with the status code
+func (s *Server) Fail(method string, prefix string, status int, times int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures = append(s.failures, &failure{method: method, prefix: prefix, status: status, times: times})
+}
+
+// AddEntity adds an existing entity to the environment, ie: a Kubernetes namespace events are attached to with an entity selector
+func (s *Server) AddEntity(entity Entity) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if entity.Tags == nil {
+		entity.Tags = map[string]string{}
+	}
+	s.entities[entity.EntityID] = &entity
+}
+
+// Entity returns a copy of the entity, or nil if it doesn't exist
+func (s *Server) Entity(entityID string) *Entity {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entity, ok := s.entities[entityID]
+	if !ok {
+		return nil
+	}
+	c := *entity
+	c.Tags = map[string]string{}
+	for key, value := range entity.Tags {
+		c.Tags[key] = value
+	}
+	return &c
+}
+
+// AddEvent adds an event sent by another source than the receiver, it opens a problem like the events received
+func (s *Server) AddEvent(event Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if event.CorrelationID == "" {
+		event.CorrelationID = fmt.Sprintf("correlation-%d", s.newID())
+	}
+	s.addEvent(event)
+}
+
+// Events returns the events received, in order
+func (s *Server) Events() []Event {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Event{}, s.events...)
+}
+
+// Problems returns the problems, open and closed
+func (s *Server) Problems() []Problem {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var problems []Problem
+	for _, problem := range s.problems {
+		problems = append(problems, *problem)
+	}
+	return problems
+}
+
+// OpenProblems returns the problems that are still open
+func (s *Server) OpenProblems() []Problem {
+	var problems []Problem
+	for _, problem := range s.Problems() {
+		if problem.Status == "OPEN" {
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+func (s *Server) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Api-Token "+s.Token {
+			writeError(w, http.StatusUnauthorized, "Missing or invalid API token")
+			return
+		}
+
+		s.lock.Lock()
+		for _, f := range s.failures {
+			if f.times > 0 && f.method == r.Method && strings.HasPrefix(r.URL.Path, f.prefix) {
+				f.times--
+				s.lock.Unlock()
+				writeError(w, f.status, "Simulated failure")
+				return
+			}
+		}
+		s.lock.Unlock()
+
+		time.Sleep(s.Latency)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{"error": map[string]interface{}{"code": status, "message": message}})
+}
+
+func (s *Server) newID() int {
+	s.nextID++
+	return s.nextID
+}
+
+// addEvent stores the event and opens or updates a problem, the lock must be held
+func (s *Server) addEvent(event Event) {
+	s.events = append(s.events, event)
+	if !problemEventTypes[event.EventType] {
+		return
+	}
+
+	for _, problem := range s.problems {
+		if problem.Status != "OPEN" || problem.Title != event.Title {
+			continue
+		}
+		for _, existing := range problem.Events {
+			if sameEntities(existing.EntityIDs, event.EntityIDs) {
+				problem.Events = append(problem.Events, event)
+				return
+			}
+		}
+	}
+
+	s.problems = append(s.problems, &Problem{
+		ProblemID: fmt.Sprintf("%d_%d", s.newID(), time.Now().UnixNano()),
+		Status:    "OPEN",
+		Title:     event.Title,
+		Events:    []Event{event},
+		CreatedAt: time.Now(),
+	})
+}
+
+func sameEntities(a []string, b []string) bool {
+	return strings.Join(a, ",") == strings.Join(b, ",")
+}
+
+// visibleProblems returns the problems old enough to have been correlated, the lock must be held
+func (s *Server) visibleProblems() []*Problem {
+	var problems []*Problem
+	for _, problem := range s.problems {
+		if time.Since(problem.CreatedAt) >= s.CorrelationDelay {
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+func (s *Server) createEventV1(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var body struct {
+		EventType   string `json:"eventType"`
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		AttachRules struct {
+			EntityIds []string `json:"entityIds"`
+		} `json:"attachRules"`
+		CustomProperties map[string]string `json:"customProperties"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, entityID := range body.AttachRules.EntityIds {
+		if _, ok := s.entities[entityID]; !ok {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Unknown entity %s", entityID))
+			return
+		}
+	}
+
+	id := s.newID()
+	event := Event{
+		CorrelationID: fmt.Sprintf("correlation-%d", id),
+		EventType:     body.EventType,
+		Title:         body.Title,
+		Description:   body.Description,
+		EntityIDs:     body.AttachRules.EntityIds,
+		Properties:    body.CustomProperties,
+		API:           "v1",
+	}
+	s.addEvent(event)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"storedEventIds":       []int{id},
+		"storedIds":            []string{fmt.Sprintf("%d", id)},
+		"storedCorrelationIds": []string{event.CorrelationID},
+	})
+}
+
+func (s *Server) createCustomDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	customDeviceID := strings.TrimPrefix(r.URL.Path, "/api/v1/entity/infrastructure/custom/")
+	var body struct {
+		DisplayName string `json:"displayName"`
+		Group       string `json:"group"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Dynatrace derives the entity IDs from the group and the custom device ID, like the receiver does
+	groupID, entityID := utils.GenerateGroupAndCustomDeviceID(body.Group, customDeviceID)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entity, ok := s.entities[entityID]
+	if !ok {
+		entity = &Entity{EntityID: entityID, Type: "CUSTOM_DEVICE", Tags: map[string]string{}}
+		s.entities[entityID] = entity
+	}
+	entity.DisplayName = body.DisplayName
+	entity.Group = body.Group
+
+	writeJSON(w, http.StatusOK, map[string]string{"entityId": entityID, "groupId": groupID})
+}
+
+func (s *Server) problemFeed(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	problems := []map[string]interface{}{}
+	for _, problem := range s.visibleProblems() {
+		if status != "" && problem.Status != status {
+			continue
+		}
+		var rankedEvents []map[string]interface{}
+		for _, event := range problem.Events {
+			rankedEvents = append(rankedEvents, map[string]interface{}{
+				"correlationId": event.CorrelationID,
+				"eventType":     event.EventType,
+				"entityId":      event.EntityIDs[0],
+			})
+		}
+		problems = append(problems, map[string]interface{}{
+			"id":           problem.ProblemID,
+			"title":        problem.Title,
+			"status":       problem.Status,
+			"rankedEvents": rankedEvents,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": map[string]interface{}{"problems": problems}})
+}
+
+func (s *Server) closeProblem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/close") {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	problemID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/problem/details/"), "/close")
+	var body struct {
+		Message string `json:"message"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, problem := range s.problems {
+		if problem.ProblemID == problemID {
+			problem.Status = "CLOSED"
+			problem.CloseComment = body.Message
+			writeJSON(w, http.StatusOK, map[string]interface{}{"closeTimestamp": time.Now().Unix() * 1000, "closeSuccess": true, "closing": true})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("Problem %s not found", problemID))
+}
+
+func (s *Server) createTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var body struct {
+		Tags []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	matched := s.selectEntities(r.URL.Query().Get("entitySelector"))
+	for _, entity := range matched {
+		for _, tag := range body.Tags {
+			entity.Tags[tag.Key] = tag.Value
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"matchedEntitiesCount": len(matched), "appliedTags": body.Tags})
+}
+
+func (s *Server) listEntities(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entities := []apiv2.Entity{}
+	for _, entity := range s.selectEntities(r.URL.Query().Get("entitySelector")) {
+		entities = append(entities, apiv2.Entity{EntityID: entity.EntityID, DisplayName: entity.DisplayName, Type: entity.Type})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"totalCount": len(entities), "pageSize": 500, "entities": entities})
+}
+
+func (s *Server) getEntity(w http.ResponseWriter, r *http.Request) {
+	entityID := strings.TrimPrefix(r.URL.Path, "/api/v2/entities/")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entity, ok := s.entities[entityID]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Entity %s not found", entityID))
+		return
+	}
+	writeJSON(w, http.StatusOK, apiv2.Entity{EntityID: entity.EntityID, DisplayName: entity.DisplayName, Type: entity.Type})
+}
+
+func (s *Server) ingestEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var body apiv2.EventIngest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var entityIDs []string
+	for _, entity := range s.selectEntities(body.EntitySelector) {
+		entityIDs = append(entityIDs, entity.EntityID)
+	}
+
+	event := Event{
+		CorrelationID: fmt.Sprintf("correlation-%d", s.newID()),
+		EventType:     body.EventType,
+		Title:         body.Title,
+		Description:   body.Properties["dt.event.description"],
+		EntityIDs:     entityIDs,
+		Properties:    body.Properties,
+		API:           "v2",
+	}
+	s.addEvent(event)
+
+	writeJSON(w, http.StatusCreated, apiv2.EventIngestResults{
+		ReportCount:        1,
+		EventIngestResults: []apiv2.EventIngestResult{{CorrelationID: event.CorrelationID, Status: "OK"}},
+	})
+}
+
+func (s *Server) listProblems(w http.ResponseWriter, r *http.Request) {
+	predicates := parseSelector(r.URL.Query().Get("problemSelector"))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	problems := []apiv2.Problem{}
+	for _, problem := range s.visibleProblems() {
+		if statuses, ok := predicates["status"]; ok && !containsFold(statuses, problem.Status) {
+			continue
+		}
+		if entityIDs, ok := predicates["entityId"]; ok && !problemAffects(problem, entityIDs) {
+			continue
+		}
+
+		var details []apiv2.Evidence
+		for _, event := range problem.Events {
+			data := &apiv2.Event{EventID: event.CorrelationID, EventType: event.EventType, CorrelationID: event.CorrelationID, Title: event.Title}
+			for key, value := range event.Properties {
+				data.Properties = append(data.Properties, apiv2.EventProperty{Key: key, Value: value})
+			}
+			details = append(details, apiv2.Evidence{
+				EvidenceType: "EVENT",
+				DisplayName:  event.Title,
+				Entity:       apiv2.EntityStub{EntityID: apiv2.EntityID{ID: event.EntityIDs[0]}},
+				EventID:      event.CorrelationID,
+				EventType:    event.EventType,
+				Data:         data,
+			})
+		}
+		problems = append(problems, apiv2.Problem{
+			ProblemID:       problem.ProblemID,
+			DisplayID:       "P-" + problem.ProblemID,
+			Title:           problem.Title,
+			Status:          problem.Status,
+			EvidenceDetails: apiv2.EvidenceDetails{TotalCount: len(details), Details: details},
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"totalCount": len(problems), "pageSize": len(problems), "problems": problems})
+}
+
+func problemAffects(problem *Problem, entityIDs []string) bool {
+	for _, event := range problem.Events {
+		for _, entityID := range event.EntityIDs {
+			if utils.StringInSlice(entityID, entityIDs) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var predicateRegex = regexp.MustCompile(`([\w.]+)\(([^)]*)\)`)
+
+// parseSelector parses the simple entity and problem selectors used by the receiver, ie: type(CUSTOM_DEVICE),entityId("a","b")
+func parseSelector(selector string) map[string][]string {
+	predicates := map[string][]string{}
+	for _, match := range predicateRegex.FindAllStringSubmatch(selector, -1) {
+		var values []string
+		for _, value := range strings.Split(match[2], ",") {
+			values = append(values, strings.Trim(strings.TrimSpace(value), `"`))
+		}
+		predicates[match[1]] = values
+	}
+	return predicates
+}
+
+// selectEntities returns the entities matching the selector, supporting the type, entityId, entityName and tag predicates
+// The lock must be held
+func (s *Server) selectEntities(selector string) []*Entity {
+	predicates := parseSelector(selector)
+	if len(predicates) == 0 {
+		return nil
+	}
+
+	var entities []*Entity
+	for _, entity := range s.entities {
+		if matchesPredicates(entity, predicates) {
+			entities = append(entities, entity)
+		}
+	}
+	return entities
+}
+
+func matchesPredicates(entity *Entity, predicates map[string][]string) bool {
+	for name, values := range predicates {
+		switch name {
+		case "type":
+			if !containsFold(values, entity.Type) {
+				return false
+			}
+		case "entityId":
+			if !utils.StringInSlice(entity.EntityID, values) {
+				return false
+			}
+		case "entityName", "entityName.equals":
+			if !utils.StringInSlice(entity.DisplayName, values) {
+				return false
+			}
+		case "tag":
+			for _, value := range values {
+				parts := strings.SplitN(value, ":", 2)
+				tagValue, ok := entity.Tags[parts[0]]
+				if !ok || (len(parts) == 2 && tagValue != parts[1]) {
+					return false
+				}
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(values []string, s string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package dynatrace
+
+import (
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/utils"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dedupWindow remembers the last notification sent to Dynatrace for each group
+// Alertmanager sends the same notification again on every repeat_interval and when a delivery failed, the copies received
+// within the window are acknowledged without sending anything
+// Only the last notification of a group is kept, so that a group flapping back to a previous state is sent again
+type dedupWindow struct {
+	window time.Duration
+
+	lock sync.Mutex
+	// sent is keyed by groupKey
+	sent map[string]sentNotification
+}
+
+type sentNotification struct {
+	key    string
+	sentAt time.Time
+	// pending is true while the notification is being sent, copies received meanwhile are duplicates too
+	pending bool
+}
+
+// reservation is a notification being sent, returned by reserve and passed to finish
+type reservation struct {
+	groupKey string
+	key      string
+	// previous is the last notification of the group before this one, it is restored if the send fails
+	previous    sentNotification
+	hasPrevious bool
+}
+
+func newDedupWindow(window time.Duration) *dedupWindow {
+	return &dedupWindow{window: window, sent: map[string]sentNotification{}}
+}
+
+// reserve returns false if the last notification of the group has this key, and was sent less than window ago or is being sent
+// Otherwise the notification is recorded as being sent, finish must then be called once the send is done
+// The expired groups are forgotten
+func (w *dedupWindow) reserve(groupKey string, key string, now time.Time) (reservation, bool) {
+	r := reservation{groupKey: groupKey, key: key}
+	if w.window <= 0 {
+		return r, true
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for k, last := range w.sent {
+		if !last.pending && now.Sub(last.sentAt) >= w.window {
+			delete(w.sent, k)
+		}
+	}
+	last, ok := w.sent[groupKey]
+	if ok && last.key == key {
+		return r, false
+	}
+	r.previous, r.hasPrevious = last, ok
+	w.sent[groupKey] = sentNotification{key: key, pending: true}
+	return r, true
+}
+
+// finish records the notification as sent, or releases it if the send failed so that its retries go through
+func (w *dedupWindow) finish(r reservation, sent bool, now time.Time) {
+	if w.window <= 0 {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	current, ok := w.sent[r.groupKey]
+	if !ok || current.key != r.key || !current.pending {
+		// Another notification of the group was received meanwhile, it is the last one
+		return
+	}
+	switch {
+	case sent:
+		w.sent[r.groupKey] = sentNotification{key: r.key, sentAt: now}
+	case r.hasPrevious:
+		w.sent[r.groupKey] = r.previous
+	default:
+		delete(w.sent, r.groupKey)
+	}
+}
+
+// notificationKey identifies the content of a notification: its status, and the fingerprint and status of each of its alerts
+// Changes of the other fields alone, like an annotation with the current value of the metric, are treated as repeats
+func notificationKey(data alertmanager.Data) string {
+	var alerts []string
+	for _, alert := range data.Alerts {
+		alerts = append(alerts, fmt.Sprintf("%s:%s", alertFingerprint(data.GroupKey, alert), alert.Status))
+	}
+	sort.Strings(alerts)
+	return fmt.Sprintf("%s/%s", data.Status, utils.Hash(strings.Join(alerts, ",")))
+}
@@ -1,49 +1,265 @@
 package dynatrace
 
 import (
+	"context"
 	"fmt"
 	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/apiv2"
 	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/cache"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dtclient"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/events"
 	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/jobs"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/metrics"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/routing"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/templates"
 	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/utils"
 	dtapi "github.com/dlopes7/dynatrace-go-client/api"
 	"github.com/prometheus/alertmanager/template"
 	log "github.com/sirupsen/logrus"
-	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 const DefaultCustomDeviceName = "Alertmanager Events"
 
 type Controller struct {
-	customDeviceCache *cache.CustomDeviceCacheService
-	problemCache      *cache.ProblemCacheService
+	customDeviceCache cache.DeviceStore
+	problemCache      cache.ProblemStore
 	scheduler         *jobs.Scheduler
-	dtClient          dtapi.Client
+	dtClient          dtclient.Client
+	apiV2             *apiv2.Client
+	events            events.Sender
 	severities        []string
+	dispatchMode      string
+	// retention is how far back the problems missing from the ProblemCache are searched
+	retention  time.Duration
+	eventTypes config.EventTypeMapping
+	router     *routing.Router
+
+	titleTemplate       *templates.Template
+	descriptionTemplate *templates.Template
+
+	// pendingTags tracks the tags being applied in the background, so that they can be flushed before exiting
+	pendingTags *sync.WaitGroup
+	// dedup acknowledges the notifications Alertmanager sends again without calling Dynatrace
+	dedup *dedupWindow
 }
 
-func NewDynatraceController(deviceCache *cache.CustomDeviceCacheService, problemCache *cache.ProblemCacheService, scheduler *jobs.Scheduler) Controller {
-	dt := dtapi.New(dtapi.Config{
-		APIKey:    os.Getenv("DT_API_TOKEN"),
-		BaseURL:   os.Getenv("DT_API_URL"),
-		Retries:   5,
-		RetryTime: 2 * time.Second,
-	})
-	severities := strings.Split(os.Getenv("WEBHOOK_PROBLEM_SEVERITIES"), ",")
+func NewDynatraceController(cfg *config.Config, dtClient dtclient.Client, deviceCache cache.DeviceStore, problemCache cache.ProblemStore, scheduler *jobs.Scheduler) Controller {
+	severities := cfg.Dynatrace.ProblemSeverities
 	log.WithFields(log.Fields{"severities": severities}).Info("Will open problems for the listed severities")
 
+	// The templates have already been validated by config.Load
+	titleTemplate, _ := templates.New("title", cfg.Templates.Title)
+	descriptionTemplate, _ := templates.New("description", cfg.Templates.Description)
+
 	return Controller{
-		dtClient:          dt,
+		dtClient:          dtClient,
+		apiV2:             apiv2.New(cfg),
+		events:            events.NewSender(cfg, dtClient),
 		customDeviceCache: deviceCache,
 		problemCache:      problemCache,
 		scheduler:         scheduler,
 		severities:        severities,
+		dispatchMode:      cfg.Dynatrace.DispatchMode,
+		retention:         cfg.Jobs.Retention,
+		eventTypes:        cfg.EventTypes,
+		router:            routing.New(cfg),
+
+		titleTemplate:       titleTemplate,
+		descriptionTemplate: descriptionTemplate,
+
+		pendingTags: &sync.WaitGroup{},
+		dedup:       newDedupWindow(cfg.Dynatrace.DedupWindow),
 	}
 }
 
 func (d *Controller) SendAlerts(data alertmanager.Data) error {
+	start := time.Now()
+	defer func() { metrics.SendAlertsDuration.Observe(time.Since(start).Seconds()) }()
+
+	reserved, ok := d.dedup.reserve(data.GroupKey, notificationKey(data), start)
+	if !ok {
+		log.WithFields(log.Fields{"groupKey": data.GroupKey, "status": data.Status, "alerts": len(data.Alerts)}).Info("Controller - Ignoring a notification already sent within the dedup window")
+		metrics.DuplicateNotifications.Inc()
+		return nil
+	}
+
+	var err error
+	if d.dispatchMode == config.DispatchModeAlert {
+		err = d.sendAlertsIndividually(data)
+	} else {
+		// This is our connection from this event to an eventual Problem in Dynatrace
+		groupKeyHash := utils.Hash(data.GroupKey)
+		log.WithFields(log.Fields{"groupKeyHash": groupKeyHash, "groupKey": data.GroupKey}).Info("Controller - Calculated the hash for the groupKey")
+		err = d.sendGroup(groupKeyHash, data)
+	}
+
+	d.dedup.finish(reserved, err == nil, time.Now())
+	return err
+}
+
+// sendGroup sends the alerts of the group as a single event, tracked in the ProblemCache under problemKey
+// A firing group can contain alerts that are already resolved: they are reported as resolved and left out of the event,
+// the problem is only closed when the whole group is resolved
+func (d *Controller) sendGroup(problemKey string, data alertmanager.Data) error {
+	if data.Status == "firing" {
+		var firing, resolved template.Alerts
+		for _, alert := range data.Alerts {
+			if alert.Status == "resolved" {
+				resolved = append(resolved, alert)
+			} else {
+				firing = append(firing, alert)
+			}
+		}
+		if len(resolved) > 0 {
+			if err := d.reportResolvedAlerts(problemKey, data.GroupKey, resolved); err != nil {
+				return err
+			}
+			data.Alerts = firing
+		}
+	}
+	return d.sendEvent(problemKey, data)
+}
+
+// reportResolvedAlerts sends an info event for each resolved alert that was still firing in the tracked problem
+// The events are attached to the entities of the problem, so that the resolution shows up next to it
+// The ProblemCache is not locked while the events are sent, the status of each alert is saved as soon as its event is sent,
+// so that a failure doesn't report the alerts before it again
+func (d *Controller) reportResolvedAlerts(problemKey string, groupKey string, resolved template.Alerts) error {
+	d.problemCache.Lock()
+	problem, ok := d.problemCache.GetCache().Problems[problemKey]
+	d.problemCache.UnLock()
+	if !ok {
+		// The group did not open a problem, there is nothing to report the alerts on
+		return nil
+	}
+
+	statuses := trackedAlertStatus(problem)
+	for _, alert := range resolved {
+		fingerprint := alertFingerprint(groupKey, alert)
+		if statuses[fingerprint] != "firing" {
+			// Already reported, or resolved before we heard of it
+			continue
+		}
+
+		title := "Alert resolved"
+		if alertname, ok := alert.Labels["alertname"]; ok {
+			title = fmt.Sprintf("%s resolved", alertname)
+		}
+		properties := map[string]string{
+			"GroupKey":     groupKey,
+			"GroupKeyHash": utils.Hash(groupKey),
+			"Fingerprint":  fingerprint,
+			"Status":       "resolved",
+		}
+		for key, value := range alert.Labels {
+			properties[fmt.Sprintf("Label: %s", key)] = value
+		}
+
+		event := dtapi.EventCreation{
+			EventType:        dtapi.EventTypeCustomInfo,
+			Source:           "AlertManager",
+			AttachRules:      problem.Event.AttachRules,
+			Title:            title,
+			Description:      fmt.Sprintf("The alert %s of the group %s is resolved, the problem stays open while other alerts of the group are firing", fingerprint, groupKey),
+			CustomProperties: properties,
+		}
+		if _, err := d.events.Send(event); err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{"problemKey": problemKey, "fingerprint": fingerprint}).Info("Controller - Reported a resolved alert of a firing group")
+		d.setAlertStatus(problemKey, fingerprint, "resolved")
+	}
+	return nil
+}
+
+// setAlertStatus saves the status of an alert of the tracked problem, it does nothing if the problem is not tracked anymore
+func (d *Controller) setAlertStatus(problemKey string, fingerprint string, status string) {
+	d.problemCache.Lock()
+	defer d.problemCache.UnLock()
+
+	problem, ok := d.problemCache.GetCache().Problems[problemKey]
+	if !ok {
+		return
+	}
+	problem.AlertStatus = trackedAlertStatus(problem)
+	problem.AlertStatus[fingerprint] = status
+	d.problemCache.Update(cache.ProblemCache{Problems: map[string]cache.Problem{problemKey: problem}})
+}
+
+// trackedAlertStatus returns a copy of the status of each alert of the problem
+func trackedAlertStatus(problem cache.Problem) map[string]string {
+	statuses := map[string]string{}
+	if problem.AlertStatus == nil {
+		for _, alert := range problem.Alert.Alerts {
+			statuses[alertFingerprint(problem.Alert.GroupKey, alert)] = alert.Status
+		}
+		return statuses
+	}
+	for fingerprint, status := range problem.AlertStatus {
+		statuses[fingerprint] = status
+	}
+	return statuses
+}
+
+// sendAlertsIndividually sends one event per alert of the group, each tracked in the ProblemCache by its fingerprint
+func (d *Controller) sendAlertsIndividually(data alertmanager.Data) error {
+	var failed []string
+
+	for _, alert := range data.Alerts {
+		problemKey := alertFingerprint(data.GroupKey, alert)
+
+		// Send a copy of the group containing only this alert, so that its status is the one we act on
+		alertData := data
+		alertData.Status = alert.Status
+		alertData.Alerts = template.Alerts{alert}
+
+		if alert.Status == "resolved" && data.Status == "firing" {
+			if !d.isTracked(problemKey) {
+				// Alertmanager keeps sending resolved alerts of a group that is still firing, we have already dealt with those
+				// Once the whole group is resolved, the untracked alerts are searched in Dynatrace
+				log.WithFields(log.Fields{"problemKey": problemKey}).Debug("Controller - Ignoring a resolved alert that is not in the ProblemCache")
+				continue
+			}
+		}
+
+		// The alerts are also deduplicated on their own, so that the retry of a notification that partially failed only sends the
+		// alerts that failed
+		reserved, ok := d.dedup.reserve(problemKey, notificationKey(alertData), time.Now())
+		if !ok {
+			log.WithFields(log.Fields{"problemKey": problemKey, "status": alert.Status}).Info("Controller - Ignoring an alert already sent within the dedup window")
+			continue
+		}
+
+		log.WithFields(log.Fields{"problemKey": problemKey, "status": alert.Status}).Info("Controller - Sending an individual alert")
+		err := d.sendEvent(problemKey, alertData)
+		d.dedup.finish(reserved, err == nil, time.Now())
+		if err != nil {
+			log.WithFields(log.Fields{"problemKey": problemKey, "error": err.Error()}).Error("Controller - Could not send the alert")
+			failed = append(failed, fmt.Sprintf("%s: %s", problemKey, err.Error()))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("could not send %d of %d alerts: %s", len(failed), len(data.Alerts), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// alertFingerprint returns the Alertmanager fingerprint of the alert
+// Older Alertmanager versions don't send it, in that case a hash of the groupKey and the labels is used instead
+func alertFingerprint(groupKey string, alert template.Alert) string {
+	if alert.Fingerprint != "" {
+		return alert.Fingerprint
+	}
+	return utils.Hash(fmt.Sprintf("%s%v", groupKey, alert.Labels.SortedPairs()))
+}
+
+// sendEvent sends the alerts to Dynatrace as a single event, which is tracked in the ProblemCache under problemKey
+func (d *Controller) sendEvent(problemKey string, data alertmanager.Data) error {
 
 	// Use the standard Custom Device Name for now, until we are able to build a new one from the labels of the alert
 	// If we are not able to craft a new custom device name, this default name will be used
@@ -55,12 +271,16 @@ func (d *Controller) SendAlerts(data alertmanager.Data) error {
 	description := fmt.Sprintf("Alert from AlertManager: %s", data.GroupKey)
 	title := fmt.Sprintf("Alert from AlertManager")
 
-	// This is our connection from this event to an eventual Problem in Dynatrace
-	groupKeyHash := utils.Hash(data.GroupKey)
-	log.WithFields(log.Fields{"groupKeyHash": groupKeyHash, "groupKey": data.GroupKey}).Info("Controller - Calculated the hash for the groupKey")
-	eventProperties["GroupKeyHash"] = groupKeyHash
+	eventProperties["GroupKeyHash"] = utils.Hash(data.GroupKey)
+	if d.dispatchMode == config.DispatchModeAlert {
+		eventProperties["Fingerprint"] = problemKey
+	}
 
 	var tagsToAdd []dtapi.Tag
+	groupName := d.router.Default().Group
+	timeoutMinutes := d.router.Default().TimeoutMinutes
+	entitySelector := ""
+	deploymentVersion := ""
 
 	// We need to gather properties, and generated a Custom Device ID based on the list of alerts
 	for i, alert := range data.Alerts {
@@ -85,16 +305,34 @@ func (d *Controller) SendAlerts(data alertmanager.Data) error {
 			description = message
 		}
 
-		// Change the eventType of the Dynatrace Event based on the severity
+		// Add the severity to the title
 		if severity, ok := alert.Labels["severity"]; ok {
 			title = fmt.Sprintf("%s (%s)", title, severity)
+		}
 
-			if utils.StringInSlice(severity, d.severities) {
-				// If this opens a problem, set the correct event type
-				// Also add the groupKeyHash to the alert title to do problem correlation
-				eventType = dtapi.EventTypeErrorEvent
-			}
-			log.WithFields(log.Fields{"severity": severity, "eventType": eventType}).Info("Controller - Setting eventType based on severity of the alert")
+		if version, ok := alert.Labels["version"]; ok {
+			deploymentVersion = version
+		} else {
+			deploymentVersion = alert.StartsAt.Format(time.RFC3339)
+		}
+
+		// The configured templates take precedence, the values computed above are the defaults if they are not set or fail
+		templateContext := templates.Context{Alert: alert, Data: data}
+		title = d.titleTemplate.Render(templateContext, title)
+		description = d.descriptionTemplate.Render(templateContext, description)
+
+		// The route decides where the event goes, in group mode the route of the last alert wins, like the other fields
+		route := d.router.Match(alert)
+		log.WithFields(log.Fields{"route": route.Name, "problemKey": problemKey}).Info("Controller - Selected the route for the alert")
+		customDeviceName = route.CustomDeviceName.Render(templateContext, customDeviceName)
+		groupName = route.Group
+		timeoutMinutes = route.TimeoutMinutes
+		entitySelector = route.EntitySelector.Render(templateContext, "")
+
+		// Once an alert of the group opens a problem, the event keeps opening a problem
+		if !opensProblem(eventType) {
+			eventType = d.eventTypeFor(alert, route)
+			log.WithFields(log.Fields{"eventType": eventType, "problemKey": problemKey}).Info("Controller - Setting eventType based on the alert")
 		}
 
 		// Add labels and annotations as custom properties of the alert
@@ -107,43 +345,38 @@ func (d *Controller) SendAlerts(data alertmanager.Data) error {
 			eventProperties[propertyKey] = value
 		}
 
-		tagsToAdd = generateSTIMETags(alert)
+		tagsToAdd = route.RenderTags(templateContext)
 	}
 
 	// Here we need to make sure we have a Custom Device before proceeding
-	_, customDeviceID := utils.GenerateGroupAndCustomDeviceID(os.Getenv("DT_GROUP_NAME"), customDeviceName)
-	log.WithFields(log.Fields{"customDeviceID": customDeviceID, "customDeviceName": customDeviceName, "groupKeyHash": groupKeyHash}).Info("Controller - Generated a Custom Device ID locally")
+	_, customDeviceID := utils.GenerateGroupAndCustomDeviceID(groupName, customDeviceName)
+	log.WithFields(log.Fields{"customDeviceID": customDeviceID, "customDeviceName": customDeviceName, "problemKey": problemKey}).Info("Controller - Generated a Custom Device ID locally")
+
+	// Tags are only applied to our own Custom Devices, never to the entities found with the entity selector
+	tagCustomDevice := entitySelector == ""
 
 	// This means we need to send an event to Dynatrace
 	if data.Status == "firing" {
 
-		// Before sending an event, make sure the Custom Device exists
-		customDeviceCache := d.customDeviceCache.GetCache(&d.dtClient)
-		if !utils.StringInSlice(customDeviceID, customDeviceCache.GetIDs()) {
-			// We don't have this Custom Device ID stored. We need to create a new Custom Device
-			cd := dtapi.CustomDevicePushMessage{
-				DisplayName: customDeviceName,
-				Group:       os.Getenv("DT_GROUP_NAME"),
-			}
-			r, _, err := d.dtClient.CustomDevice.Create(customDeviceName, cd)
-			if err != nil {
+		// Attach the event to the existing Dynatrace entities matching the selector, if any, otherwise to the Custom Device
+		entityIDs := d.findEntities(entitySelector, problemKey)
+		if len(entityIDs) == 0 {
+			// Before sending an event, make sure the Custom Device exists
+			if err := d.ensureCustomDevice(customDeviceID, customDeviceName, groupName, problemKey); err != nil {
 				// We were not able to create the custom device, abort
 				return err
 			}
-			customDeviceCache.CustomDevices = append(customDeviceCache.CustomDevices, cache.CustomDevice{ID: r.EntityID, Name: customDeviceName, Group: os.Getenv("DT_GROUP_NAME")})
-			d.customDeviceCache.Update(*customDeviceCache)
-			log.WithFields(log.Fields{"CustomDeviceID": r.EntityID, "groupKeyHash": groupKeyHash}).Info("Controller - Created a new Custom Device using the API")
-		} else {
-			log.WithFields(log.Fields{"CustomDeviceID": customDeviceID, "groupKeyHash": groupKeyHash}).Info("Controller - Found the CustomDeviceID in the local cache")
+			entityIDs = []string{customDeviceID}
+			tagCustomDevice = true
 		}
 
 		// Create the event object
 		event := dtapi.EventCreation{
 			EventType:      eventType,
 			Source:         "AlertManager",
-			TimeoutMinutes: 120,
+			TimeoutMinutes: timeoutMinutes,
 			AttachRules: dtapi.PushEventAttachRules{
-				EntityIds: []string{customDeviceID},
+				EntityIds: entityIDs,
 			},
 			Description:      description,
 			Title:            title,
@@ -151,51 +384,300 @@ func (d *Controller) SendAlerts(data alertmanager.Data) error {
 			AllowDavisMerge:  false,
 		}
 
+		// Some event types have their own mandatory fields
+		switch string(eventType) {
+		case "CUSTOM_ANNOTATION":
+			event.AnnotationType = title
+			event.AnnotationDescription = description
+		case "CUSTOM_DEPLOYMENT":
+			event.DeploymentName = title
+			event.DeploymentVersion = deploymentVersion
+		}
+
 		// Send to Dynatrace
-		r, _, err := d.dtClient.Events.Create(event)
+		r, err := d.events.Send(event)
 		if err != nil {
 			return err
 		}
-		log.WithFields(log.Fields{"response": fmt.Sprintf("%+v", r), "groupKeyHash": groupKeyHash}).Info("Controller - Dynatrace response after sending the event")
+		log.WithFields(log.Fields{"response": fmt.Sprintf("%+v", r), "problemKey": problemKey}).Info("Controller - Dynatrace response after sending the event")
 
 		// If this event was a problem opening event, add it to the cache
-		if eventType == dtapi.EventTypeErrorEvent {
-			log.WithFields(log.Fields{"groupKeyHash": groupKeyHash}).Info("Adding the problem to the local cache")
-
-			p := cache.Problem{
+		if opensProblem(eventType) {
+			alertStatus := map[string]string{}
+			for _, alert := range data.Alerts {
+				alertStatus[alertFingerprint(data.GroupKey, alert)] = alert.Status
+			}
+			d.trackProblem(problemKey, cache.Problem{
 				Event:            event,
 				Alert:            data,
 				EventStoreResult: *r,
 				CreatedAt:        time.Now(),
-			}
-			d.problemCache.AddProblem(groupKeyHash, p)
+				AlertStatus:      alertStatus,
+			})
 		}
-	} else if data.Status == "resolved" && eventType == dtapi.EventTypeErrorEvent {
+	} else if data.Status == "resolved" && (opensProblem(eventType) || d.isTracked(problemKey)) {
 		// If we get here, we need to manually close the Dynatrace Problem
+		// Events that don't open problems (info, annotations, deployments...) have nothing to close, unless the event type changed since they were sent
 
-		log.WithFields(log.Fields{"groupKeyHash": groupKeyHash}).Info("Controller - Received a resolved error event, need to close the problem")
-		err := d.CloseProblem(groupKeyHash)
-		if err != nil {
+		log.WithFields(log.Fields{"problemKey": problemKey}).Info("Controller - Received a resolved error event, need to close the problem")
+		if d.isTracked(problemKey) {
+			if err := d.CloseProblem(problemKey); err != nil {
+				return err
+			}
+		} else {
+			entityIDs := append([]string{customDeviceID}, d.findEntities(entitySelector, problemKey)...)
+			if err := d.closeUntrackedProblems(problemKey, entityIDs, eventProperties); err != nil {
+				return err
+			}
+		}
+	}
+
+	if tagsToAdd != nil && tagCustomDevice {
+		d.pendingTags.Add(1)
+		go func() {
+			defer d.pendingTags.Done()
+			d.sendTags(customDeviceID, tagsToAdd)
+		}()
+	}
+
+	return nil
+}
+
+// closeUntrackedProblems closes the open problems opened by our events for a problemKey missing from the ProblemCache
+// It happens when the cache was lost, or when the receiver was down while the alert fired
+// Our events are recognized by their GroupKeyHash and Fingerprint properties, the Custom Device is shared by every group and possibly
+// by other sources, so a problem without these properties in its evidence is never closed
+func (d *Controller) closeUntrackedProblems(problemKey string, entityIDs []string, properties map[string]string) error {
+	log.WithFields(log.Fields{"problemKey": problemKey, "entityIDs": entityIDs}).Warning("Controller - The problem is not in the ProblemCache, searching the open problems in Dynatrace")
+
+	problemSelector := fmt.Sprintf(`status("open"),%s`, events.EntityIDSelector(entityIDs))
+	dtProblems, err := d.apiV2.ListProblems(problemSelector, time.Now().Add(-d.retention))
+	if err != nil {
+		return fmt.Errorf("could not search the open problems of %s in Dynatrace: %s", problemKey, err.Error())
+	}
+
+	comment := fmt.Sprintf("Dynatrace alertmanager receiver automatically closed the problem after receiving a resolved event with hash %s, the problem was found by searching the open problems", problemKey)
+	closed := 0
+	for _, dtProblem := range dtProblems {
+		if !openedBy(dtProblem, properties) {
+			continue
+		}
+		log.WithFields(log.Fields{"problemKey": problemKey, "problem": dtProblem.ProblemID}).Info("Controller - Found an open problem for the resolved event, closing it")
+		if err := d.dtClient.CloseProblem(dtProblem.ProblemID, comment); err != nil {
 			return err
 		}
+		closed++
+	}
+
+	if closed == 0 {
+		log.WithFields(log.Fields{"problemKey": problemKey}).Warning("Controller - Could not find an open problem for the resolved event, there is nothing to close")
+	}
+	return nil
+}
+
+// openedBy returns true if one of our events, with the same tracking properties, is evidence of the problem
+func openedBy(dtProblem apiv2.Problem, properties map[string]string) bool {
+	for _, evidence := range dtProblem.EvidenceDetails.Details {
+		if evidence.EvidenceType != "EVENT" || evidence.Data == nil {
+			continue
+		}
+		if jobs.HasTrackingProperties(evidence.Data, properties) {
+			return true
+		}
+	}
+	return false
+}
+
+// trackProblem adds the problem to the ProblemCache
+// If the problemKey is already tracked, the entry is updated with the new event and alerts: it keeps its ProblemID, its creation
+// time, the correlation IDs of the previous events, which are still evidence of the same problem in Dynatrace, and the status of
+// the alerts missing from the new notification
+func (d *Controller) trackProblem(problemKey string, p cache.Problem) {
+	d.problemCache.Lock()
+	defer d.problemCache.UnLock()
+
+	// Update only saves the problems it is given
+	update := cache.ProblemCache{Problems: map[string]cache.Problem{problemKey: p}}
+
+	existing, ok := d.problemCache.GetCache().Problems[problemKey]
+	if !ok {
+		log.WithFields(log.Fields{"problemKey": problemKey}).Info("Adding the problem to the local cache")
+		d.problemCache.Update(update)
+		return
+	}
+
+	log.WithFields(log.Fields{"problemKey": problemKey, "problemID": existing.ProblemID}).Info("Controller - Updating the problem already in the local cache")
+	p.ProblemID = existing.ProblemID
+	p.UpdatedAt = p.CreatedAt
+	p.CreatedAt = existing.CreatedAt
+	correlationIDs := existing.EventStoreResult.StoredCorrelationIds
+	for _, correlationID := range p.EventStoreResult.StoredCorrelationIds {
+		if !utils.StringInSlice(correlationID, correlationIDs) {
+			correlationIDs = append(correlationIDs, correlationID)
+		}
+	}
+	p.EventStoreResult.StoredCorrelationIds = correlationIDs
+	alertStatus := trackedAlertStatus(existing)
+	for fingerprint, status := range p.AlertStatus {
+		alertStatus[fingerprint] = status
+	}
+	p.AlertStatus = alertStatus
+	update.Problems[problemKey] = p
+	d.problemCache.Update(update)
+}
+
+// findEntities returns the IDs of the entities matching the entity selector
+// It returns nil if there is no selector, if it matches nothing or if the entities could not be listed
+func (d *Controller) findEntities(entitySelector string, problemKey string) []string {
+	if entitySelector == "" {
+		return nil
 	}
 
-	if tagsToAdd != nil {
-		go d.sendTags(customDeviceID, tagsToAdd)
+	entities, err := d.apiV2.ListEntities(entitySelector)
+	if err != nil {
+		log.WithFields(log.Fields{"entitySelector": entitySelector, "problemKey": problemKey, "error": err.Error()}).Warning("Controller - Could not list the entities, falling back to the Custom Device")
+		return nil
+	}
+	if len(entities) == 0 {
+		log.WithFields(log.Fields{"entitySelector": entitySelector, "problemKey": problemKey}).Info("Controller - The entity selector did not match any entity, falling back to the Custom Device")
+		return nil
 	}
 
+	var entityIDs []string
+	for _, entity := range entities {
+		entityIDs = append(entityIDs, entity.EntityID)
+	}
+	log.WithFields(log.Fields{"entitySelector": entitySelector, "entityIDs": entityIDs, "problemKey": problemKey}).Info("Controller - Attaching the event to the entities matching the entity selector")
+	return entityIDs
+}
+
+// ensureCustomDevice creates the Custom Device in Dynatrace, unless it is already in the CustomDeviceCache
+func (d *Controller) ensureCustomDevice(customDeviceID string, customDeviceName string, groupName string, problemKey string) error {
+	customDeviceCache := d.customDeviceCache.GetCache(d.dtClient)
+	if utils.StringInSlice(customDeviceID, customDeviceCache.GetIDs()) {
+		log.WithFields(log.Fields{"CustomDeviceID": customDeviceID, "problemKey": problemKey}).Info("Controller - Found the CustomDeviceID in the local cache")
+		return nil
+	}
+
+	// We don't have this Custom Device ID stored. We need to create a new Custom Device
+	cd := dtapi.CustomDevicePushMessage{
+		DisplayName: customDeviceName,
+		Group:       groupName,
+	}
+	entityID, err := d.dtClient.CreateCustomDevice(customDeviceName, cd)
+	if err != nil {
+		return err
+	}
+	// Another notification may have added devices meanwhile, only add this one
+	d.customDeviceCache.AddCustomDevice(d.dtClient, cache.CustomDevice{ID: entityID, Name: customDeviceName, Group: groupName})
+	log.WithFields(log.Fields{"CustomDeviceID": entityID, "problemKey": problemKey}).Info("Controller - Created a new Custom Device using the API")
 	return nil
 }
 
+// CustomDevices returns the Custom Devices in the CustomDeviceCache
+func (d *Controller) CustomDevices() []cache.CustomDevice {
+	return d.customDeviceCache.GetCache(d.dtClient).CustomDevices
+}
+
+// CustomDeviceSync is the result of pushing a cached Custom Device to Dynatrace again
+type CustomDeviceSync struct {
+	cache.CustomDevice
+	Error string `json:"error,omitempty"`
+}
+
+// ResyncCustomDevices pushes every cached Custom Device to Dynatrace again, recreating the ones that were deleted
+// The Custom Device IDs only depend on the group and the name, so the recreated devices keep their ID
+func (d *Controller) ResyncCustomDevices() []CustomDeviceSync {
+	customDeviceCache := d.customDeviceCache.GetCache(d.dtClient)
+
+	var results []CustomDeviceSync
+	for _, customDevice := range customDeviceCache.CustomDevices {
+		result := CustomDeviceSync{CustomDevice: customDevice}
+		if customDevice.Name == customDevice.ID {
+			// Devices imported from the first cache format only have their ID, pushing them would create a new device
+			result.Error = "the name of the Custom Device is unknown, it can't be pushed again"
+			results = append(results, result)
+			continue
+		}
+		entityID, err := d.dtClient.CreateCustomDevice(customDevice.Name, dtapi.CustomDevicePushMessage{
+			DisplayName: customDevice.Name,
+			Group:       customDevice.Group,
+		})
+		if err != nil {
+			log.WithFields(log.Fields{"CustomDeviceID": customDevice.ID, "error": err.Error()}).Error("Controller - Could not resync the Custom Device")
+			result.Error = err.Error()
+		} else if entityID != customDevice.ID {
+			// The ID is derived from the group and the name, this only happens if the cached group is wrong
+			log.WithFields(log.Fields{"CustomDeviceID": customDevice.ID, "entityID": entityID}).Warning("Controller - The Custom Device was pushed with a different ID, updating the cache")
+			result.ID = entityID
+			d.customDeviceCache.ReplaceCustomDevice(d.dtClient, customDevice.ID, result.CustomDevice)
+		}
+		results = append(results, result)
+	}
+
+	log.WithFields(log.Fields{"customDevices": len(results)}).Info("Controller - Resynced the Custom Devices")
+	return results
+}
+
+// eventTypeFor returns the event type for an alert, from the route, the event type mapping or the problem severities, in this order
+func (d *Controller) eventTypeFor(alert template.Alert, route *routing.Route) dtapi.EventType {
+	if route.EventType != "" {
+		return dtapi.EventType(route.EventType)
+	}
+
+	if eventType, ok := d.eventTypes.Mapping[alert.Labels[d.eventTypes.Label]]; ok {
+		return dtapi.EventType(eventType)
+	}
+
+	if severity, ok := alert.Labels["severity"]; ok && utils.StringInSlice(severity, d.severities) {
+		return dtapi.EventTypeErrorEvent
+	}
+
+	if d.eventTypes.Default != "" {
+		return dtapi.EventType(d.eventTypes.Default)
+	}
+	return dtapi.EventTypeCustomInfo
+}
+
+// isTracked returns true if the problemKey is in the ProblemCache
+func (d *Controller) isTracked(problemKey string) bool {
+	_, ok := d.problemCache.GetCache().Problems[problemKey]
+	return ok
+}
+
+// opensProblem returns true for the event types that open a problem in Dynatrace, those need to be tracked and closed
+func opensProblem(eventType dtapi.EventType) bool {
+	switch string(eventType) {
+	case "AVAILABILITY_EVENT", "CUSTOM_ALERT", "ERROR_EVENT", "PERFORMANCE_EVENT", "RESOURCE_CONTENTION":
+		return true
+	}
+	return false
+}
+
+// FlushTags waits for the tags being applied in the background, it returns false if they are still pending when ctx is done
+func (d *Controller) FlushTags(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		d.pendingTags.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func (d *Controller) sendTags(customDeviceID string, tags []dtapi.Tag) bool {
 	selector := fmt.Sprintf("entityId(\"%s\")", customDeviceID)
 
 	for i := 0; i < 10; i++ {
-		tagResponse, _, err := d.dtClient.CustomTags.Create(selector, tags)
-		log.WithFields(log.Fields{"selector": selector, "error": err, "tags": tagResponse, "attempt": i + 1}).Debug("Attempted to send tags")
-		if tagResponse != nil {
-			if tagResponse.MatchedEntitiesCount > 0 {
-				log.WithFields(log.Fields{"selector": selector, "tags": tagResponse, "attempt": i + 1}).Info("Successfully applied tags")
+		matchedEntities, err := d.dtClient.CreateTags(selector, tags)
+		log.WithFields(log.Fields{"selector": selector, "error": err, "matchedEntities": matchedEntities, "attempt": i + 1}).Debug("Attempted to send tags")
+		if err == nil {
+			if matchedEntities > 0 {
+				log.WithFields(log.Fields{"selector": selector, "tags": tags, "attempt": i + 1}).Info("Successfully applied tags")
 				return true
 			} else {
 				time.Sleep(5 * time.Second)
@@ -207,26 +689,26 @@ func (d *Controller) sendTags(customDeviceID string, tags []dtapi.Tag) bool {
 
 }
 
-func (d *Controller) CloseProblem(groupKeyHash string) error {
-	comment := fmt.Sprintf("Dynatrace alertmanager receiver automatically closed the problem after receiving a resolved event with hash %s", groupKeyHash)
+func (d *Controller) CloseProblem(problemKey string) error {
+	comment := fmt.Sprintf("Dynatrace alertmanager receiver automatically closed the problem after receiving a resolved event with hash %s", problemKey)
 
 	d.problemCache.Lock()
 	problemCache := d.problemCache.GetCache()
 
 	// Check if the hash exists in the problems cache. This should always be true unless we receive an resolved event twice in a row
-	if cachedProblem, ok := problemCache.Problems[groupKeyHash]; ok {
+	if cachedProblem, ok := problemCache.Problems[problemKey]; ok {
 
 		// If we have a problem ID, we can close the problem!
 		if cachedProblem.ProblemID != "" {
-			log.WithFields(log.Fields{"groupKeyHash": groupKeyHash, "problem": cachedProblem.ProblemID}).Info("Controller - Found problem, closing it")
-			_, err := d.dtClient.Problem.Close(cachedProblem.ProblemID, comment)
+			log.WithFields(log.Fields{"problemKey": problemKey, "problem": cachedProblem.ProblemID}).Info("Controller - Found problem, closing it")
+			err := d.dtClient.CloseProblem(cachedProblem.ProblemID, comment)
 			if err != nil {
 				d.problemCache.UnLock()
 				return err
 			}
 		} else {
 			// We could not find the ProblemID for this event, maybe it resolved too fast, before the Problem Job could have updated it
-			log.WithFields(log.Fields{"groupKeyHash": groupKeyHash}).Warning("Controller - Found an event on the ProblemCache, but no ProblemID, attempting to update the cache now")
+			log.WithFields(log.Fields{"problemKey": problemKey}).Warning("Controller - Found an event on the ProblemCache, but no ProblemID, attempting to update the cache now")
 			d.problemCache.UnLock()
 			d.scheduler.UpdateProblemIDs()
 
@@ -234,17 +716,17 @@ func (d *Controller) CloseProblem(groupKeyHash string) error {
 			// Basically, try everything we just tried one more time
 			d.problemCache.Lock()
 			problemCache = d.problemCache.GetCache()
-			if cachedProblem, ok := problemCache.Problems[groupKeyHash]; ok {
+			if cachedProblem, ok := problemCache.Problems[problemKey]; ok {
 				if cachedProblem.ProblemID != "" {
-					_, err := d.dtClient.Problem.Close(cachedProblem.ProblemID, comment)
+					err := d.dtClient.CloseProblem(cachedProblem.ProblemID, comment)
 					if err != nil {
 						d.problemCache.UnLock()
 						return err
 					}
 				} else {
-					d.problemCache.Delete(groupKeyHash)
+					d.problemCache.Delete(problemKey)
 					d.problemCache.UnLock()
-					return fmt.Errorf("found the event (%s) in the cache, but could not get a ProblemID from Dynatrace even after a manual scan", groupKeyHash)
+					return fmt.Errorf("found the event (%s) in the cache, but could not get a ProblemID from Dynatrace even after a manual scan", problemKey)
 				}
 			}
 		}
@@ -253,83 +735,15 @@ func (d *Controller) CloseProblem(groupKeyHash string) error {
 		// This should not happen because AlertManager does not send a resolved event twice
 		// But it could happen, for instance if this receiver was offline when the alert was created, and we only receive a resolved event
 		// Still attempt to delete the hash, which was not found, who knows...
-		d.problemCache.Delete(groupKeyHash)
+		d.problemCache.Delete(problemKey)
 		d.problemCache.UnLock()
-		return fmt.Errorf("could not find an event with hash %s in the ProblemCache, can't close the event", groupKeyHash)
+		return fmt.Errorf("could not find an event with hash %s in the ProblemCache, can't close the event", problemKey)
 	}
 
 	// If we get here, the problem has been closed successfully
-	log.WithFields(log.Fields{"groupKeyHash": groupKeyHash}).Info("Controller - The problem has been closed successfully")
-	d.problemCache.Delete(groupKeyHash)
+	log.WithFields(log.Fields{"problemKey": problemKey}).Info("Controller - The problem has been closed successfully")
+	d.problemCache.Delete(problemKey)
 	d.problemCache.UnLock()
 	return nil
 
 }
-
-func generateSTIMETags(alert template.Alert) []dtapi.Tag {
-
-	var tagsToAdd []dtapi.Tag
-
-	// STIME requirements, add tags based on labels
-	if labelCodeApp, ok := alert.Labels["label_code_app"]; ok {
-		tagsToAdd = append(tagsToAdd, dtapi.Tag{
-			Key:   "CodeAppli",
-			Value: labelCodeApp,
-		})
-
-		if namespace, ok := alert.Labels["namespace"]; ok {
-			tagsToAdd = append(tagsToAdd, dtapi.Tag{
-				Key:   "Appname",
-				Value: namespace,
-			})
-		}
-
-		if labelEnv, ok := alert.Labels["label_env"]; ok {
-			tagsToAdd = append(tagsToAdd, dtapi.Tag{
-				Key:   "Plateforme",
-				Value: labelEnv,
-			})
-		}
-
-		if ocpCluster, ok := alert.Labels["ocp_cluster"]; ok {
-			tagsToAdd = append(tagsToAdd, dtapi.Tag{
-				Key:   "Clustername",
-				Value: ocpCluster,
-			})
-		}
-
-	} else if ocpCluster, ok := alert.Labels["ocp_cluster"]; ok {
-		tagsToAdd = append(tagsToAdd,
-			dtapi.Tag{
-				Key:   "Clustername",
-				Value: ocpCluster,
-			},
-			dtapi.Tag{
-				Key:   "Appname",
-				Value: "k8S",
-			},
-			dtapi.Tag{
-				Key:   "CodeAppli",
-				Value: "i3",
-			},
-		)
-
-		if ocpCluster == "ocp4-intra-prod" {
-			tagsToAdd = append(tagsToAdd,
-				dtapi.Tag{
-					Key:   "Plateforme",
-					Value: "p",
-				},
-			)
-		} else if ocpCluster == "ocp4-intra-dev" {
-			tagsToAdd = append(tagsToAdd,
-				dtapi.Tag{
-					Key:   "Plateforme",
-					Value: "r",
-				},
-			)
-		}
-	}
-
-	return tagsToAdd
-}
@@ -0,0 +1,570 @@
+package dynatrace
+
+import (
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/cache"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dtclient"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dtclient/fake"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/events"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/jobs"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/metrics"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/utils"
+	dtapi "github.com/dlopes7/dynatrace-go-client/api"
+	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type testEnv struct {
+	dt           *fake.Server
+	controller   Controller
+	scheduler    *jobs.Scheduler
+	problemCache cache.ProblemStore
+}
+
+// newTestEnv starts a fake Dynatrace environment and a Controller using it, configure can change the configuration before it is used
+func newTestEnv(t *testing.T, configure func(cfg *config.Config)) *testEnv {
+	dt := fake.New("my-token")
+	t.Cleanup(dt.Close)
+
+	cfg := config.Default()
+	cfg.Dynatrace.APIURL = dt.URL
+	cfg.Dynatrace.APIToken = "my-token"
+	cfg.Dynatrace.GroupName = "Alertmanager"
+	cfg.Dynatrace.ProblemSeverities = []string{"critical"}
+	cfg.Dynatrace.Retries = 0
+	cfg.Dynatrace.RetryTime = time.Millisecond
+	cfg.Cache.Backend = config.CacheBackendMemory
+	if configure != nil {
+		configure(cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, _ := cache.OpenStorage(cfg)
+	deviceCache := cache.NewCustomDeviceCacheService(cfg, storage)
+	problemCache := cache.NewProblemCacheService(storage)
+	dtClient := dtclient.New(cfg)
+	scheduler := jobs.NewScheduler(cfg, dtClient, &deviceCache, &problemCache)
+
+	return &testEnv{
+		dt:           dt,
+		controller:   NewDynatraceController(cfg, dtClient, &deviceCache, &problemCache, &scheduler),
+		scheduler:    &scheduler,
+		problemCache: &problemCache,
+	}
+}
+
+func notification(status string, alerts ...template.Alert) alertmanager.Data {
+	for i := range alerts {
+		alerts[i].Status = status
+	}
+	return alertmanager.Data{
+		Receiver: "dynatrace",
+		Status:   status,
+		GroupKey: `{}:{alertname="KubePodCrashLooping"}`,
+		Alerts:   alerts,
+	}
+}
+
+func crashLooping(pod string, severity string) template.Alert {
+	return template.Alert{
+		Labels: template.KV{
+			"alertname": "KubePodCrashLooping",
+			"namespace": "shop",
+			"service":   "cart",
+			"pod":       pod,
+			"severity":  severity,
+		},
+		Annotations: template.KV{"message": "Pod " + pod + " is crash looping"},
+		StartsAt:    time.Now(),
+		Fingerprint: utils.Hash(pod),
+	}
+}
+
+func TestFiringCorrelateResolveClose(t *testing.T) {
+	env := newTestEnv(t, nil)
+
+	assert.NoError(t, env.controller.SendAlerts(notification("firing", crashLooping("cart-1", "critical"))))
+
+	events := env.dt.Events()
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "ERROR_EVENT", events[0].EventType)
+		assert.Equal(t, "KubePodCrashLooping (critical)", events[0].Title)
+		assert.Equal(t, "Pod cart-1 is crash looping", events[0].Description)
+		_, customDeviceID := utils.GenerateGroupAndCustomDeviceID("Alertmanager", "Alertmanager - shop: cart")
+		assert.Equal(t, []string{customDeviceID}, events[0].EntityIDs)
+		assert.NotNil(t, env.dt.Entity(customDeviceID))
+	}
+	assert.Len(t, env.dt.OpenProblems(), 1)
+
+	env.scheduler.UpdateProblemIDs()
+	problemKey := utils.Hash(`{}:{alertname="KubePodCrashLooping"}`)
+	cached, ok := env.problemCache.GetCache().Problems[problemKey]
+	if assert.True(t, ok) {
+		assert.Equal(t, env.dt.OpenProblems()[0].ProblemID, cached.ProblemID)
+	}
+
+	assert.NoError(t, env.controller.SendAlerts(notification("resolved", crashLooping("cart-1", "critical"))))
+	assert.Empty(t, env.dt.OpenProblems())
+	assert.Contains(t, env.dt.Problems()[0].CloseComment, problemKey)
+	assert.Empty(t, env.problemCache.GetCache().Problems)
+}
+
+func TestResolvedBeforeTheScheduledCorrelation(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.dt.CorrelationDelay = 50 * time.Millisecond
+
+	assert.NoError(t, env.controller.SendAlerts(notification("firing", crashLooping("cart-1", "critical"))))
+
+	// Dynatrace has not correlated the event yet
+	env.scheduler.UpdateProblemIDs()
+	for _, problem := range env.problemCache.GetCache().Problems {
+		assert.Empty(t, problem.ProblemID)
+	}
+
+	// The problem ID is looked up again when the alert resolves
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, env.controller.SendAlerts(notification("resolved", crashLooping("cart-1", "critical"))))
+	assert.Empty(t, env.dt.OpenProblems())
+	assert.Empty(t, env.problemCache.GetCache().Problems)
+}
+
+func TestInfoAlertsDontOpenProblems(t *testing.T) {
+	env := newTestEnv(t, nil)
+
+	assert.NoError(t, env.controller.SendAlerts(notification("firing", crashLooping("cart-1", "warning"))))
+	assert.NoError(t, env.controller.SendAlerts(notification("resolved", crashLooping("cart-1", "warning"))))
+
+	events := env.dt.Events()
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "CUSTOM_INFO", events[0].EventType)
+	}
+	assert.Empty(t, env.dt.Problems())
+	assert.Empty(t, env.problemCache.GetCache().Problems)
+}
+
+func TestPartiallyResolvedGroup(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.Dynatrace.DedupWindow = 0
+	})
+	problemKey := utils.Hash(`{}:{alertname="KubePodCrashLooping"}`)
+	first, second := crashLooping("cart-1", "critical"), crashLooping("cart-2", "critical")
+
+	assert.NoError(t, env.controller.SendAlerts(notification("firing", first, second)))
+	env.scheduler.UpdateProblemIDs()
+	assert.Equal(t, map[string]string{first.Fingerprint: "firing", second.Fingerprint: "firing"}, env.problemCache.GetCache().Problems[problemKey].AlertStatus)
+
+	// The first alert resolves while the second one is still firing
+	data := notification("firing", first, second)
+	data.Alerts[0].Status = "resolved"
+	assert.NoError(t, env.controller.SendAlerts(data))
+	events := env.dt.Events()
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, "CUSTOM_INFO", events[1].EventType)
+		assert.Equal(t, "KubePodCrashLooping resolved", events[1].Title)
+		assert.Equal(t, first.Fingerprint, events[1].Properties["Fingerprint"])
+		assert.Equal(t, events[0].EntityIDs, events[1].EntityIDs)
+		assert.Equal(t, "ERROR_EVENT", events[2].EventType)
+		assert.Equal(t, "cart-2", events[2].Properties["Alert 1 - Label: pod"])
+		assert.NotContains(t, events[2].Properties, "Alert 2 - Label: pod")
+	}
+	assert.Len(t, env.dt.OpenProblems(), 1)
+	cached := env.problemCache.GetCache().Problems[problemKey]
+	assert.Equal(t, map[string]string{first.Fingerprint: "resolved", second.Fingerprint: "firing"}, cached.AlertStatus)
+	assert.NotEmpty(t, cached.ProblemID)
+
+	// The resolution is only reported once
+	assert.NoError(t, env.controller.SendAlerts(data))
+	assert.Len(t, env.dt.Events(), 4)
+
+	// The problem closes with the last firing alert
+	assert.NoError(t, env.controller.SendAlerts(notification("resolved", first, second)))
+	assert.Empty(t, env.dt.OpenProblems())
+	assert.Empty(t, env.problemCache.GetCache().Problems)
+}
+
+// lockCheckingSender fails the send number failAt, and fails the test if the ProblemCache is locked during a send
+type lockCheckingSender struct {
+	t            *testing.T
+	next         events.Sender
+	problemCache cache.ProblemStore
+	sends        int
+	failAt       int
+}
+
+func (s *lockCheckingSender) Send(event dtapi.EventCreation) (*dtapi.EventStoreResult, error) {
+	locked := make(chan struct{})
+	go func() {
+		s.problemCache.Lock()
+		s.problemCache.UnLock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		s.t.Fatal("the problem cache is locked while sending an event")
+	}
+
+	s.sends++
+	if s.sends == s.failAt {
+		return nil, fmt.Errorf("send %d failed", s.sends)
+	}
+	return s.next.Send(event)
+}
+
+func TestPartiallyResolvedGroupFailure(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.Dynatrace.DedupWindow = 0
+	})
+	problemKey := utils.Hash(`{}:{alertname="KubePodCrashLooping"}`)
+	first, second, third := crashLooping("cart-1", "critical"), crashLooping("cart-2", "critical"), crashLooping("cart-3", "critical")
+	assert.NoError(t, env.controller.SendAlerts(notification("firing", first, second, third)))
+
+	// Two alerts resolve, the report of the second one fails
+	sender := &lockCheckingSender{t: t, next: env.controller.events, problemCache: env.problemCache, failAt: 2}
+	env.controller.events = sender
+	data := notification("firing", first, second, third)
+	data.Alerts[0].Status = "resolved"
+	data.Alerts[1].Status = "resolved"
+	assert.Error(t, env.controller.SendAlerts(data))
+	assert.Equal(t, map[string]string{first.Fingerprint: "resolved", second.Fingerprint: "firing", third.Fingerprint: "firing"}, env.problemCache.GetCache().Problems[problemKey].AlertStatus)
+
+	// The retry only reports the second alert
+	assert.NoError(t, env.controller.SendAlerts(data))
+	events := env.dt.Events()
+	if assert.Len(t, events, 4) {
+		assert.Equal(t, first.Fingerprint, events[1].Properties["Fingerprint"])
+		assert.Equal(t, second.Fingerprint, events[2].Properties["Fingerprint"])
+	}
+	assert.Equal(t, map[string]string{first.Fingerprint: "resolved", second.Fingerprint: "resolved", third.Fingerprint: "firing"}, env.problemCache.GetCache().Problems[problemKey].AlertStatus)
+}
+
+func TestResolvedWithoutCacheEntry(t *testing.T) {
+	env := newTestEnv(t, nil)
+	problemKey := utils.Hash(`{}:{alertname="KubePodCrashLooping"}`)
+
+	// Another group with a problem on the same Custom Device
+	other := notification("firing", crashLooping("cart-1", "critical"))
+	other.GroupKey = `{}:{alertname="KubePodNotReady"}`
+	other.Alerts[0].Labels["alertname"] = "KubePodNotReady"
+	assert.NoError(t, env.controller.SendAlerts(other))
+
+	assert.NoError(t, env.controller.SendAlerts(notification("firing", crashLooping("cart-1", "critical"))))
+	assert.Len(t, env.dt.OpenProblems(), 2)
+
+	// The cache was lost
+	env.problemCache.Delete(problemKey)
+	assert.NoError(t, env.controller.SendAlerts(notification("resolved", crashLooping("cart-1", "critical"))))
+	open := env.dt.OpenProblems()
+	if assert.Len(t, open, 1) {
+		assert.Equal(t, "KubePodNotReady (critical)", open[0].Title)
+	}
+	for _, problem := range env.dt.Problems() {
+		if problem.Status == "CLOSED" {
+			assert.Contains(t, problem.CloseComment, problemKey)
+		}
+	}
+
+	// Nothing left to close, a problem with the same title from another source on the Custom Device is left open
+	customDeviceIDs := env.dt.Events()[0].EntityIDs
+	env.dt.AddEvent(fake.Event{EventType: "ERROR_EVENT", Title: "KubePodCrashLooping (critical)", EntityIDs: customDeviceIDs, API: "v1"})
+	env.controller.dedup.window = 0
+	assert.NoError(t, env.controller.SendAlerts(notification("resolved", crashLooping("cart-1", "critical"))))
+	assert.Len(t, env.dt.OpenProblems(), 2)
+}
+
+func TestReconcile(t *testing.T) {
+	for _, problemsAPI := range []string{config.APIVersion1, config.APIVersion2} {
+		env := newTestEnv(t, func(cfg *config.Config) {
+			cfg.Dynatrace.ProblemsAPI = problemsAPI
+		})
+
+		notReady := notification("firing", crashLooping("cart-1", "critical"))
+		notReady.GroupKey = `{}:{alertname="KubePodNotReady"}`
+		notReady.Alerts[0].Labels["alertname"] = "KubePodNotReady"
+		assert.NoError(t, env.controller.SendAlerts(notReady))
+		assert.NoError(t, env.controller.SendAlerts(notification("firing", crashLooping("cart-1", "critical"))))
+		env.scheduler.UpdateProblemIDs()
+		crashLoopingKey, notReadyKey := utils.Hash(`{}:{alertname="KubePodCrashLooping"}`), utils.Hash(notReady.GroupKey)
+		problems := env.problemCache.GetCache().Problems
+
+		// One problem is closed by hand, the ProblemID of the other one is outdated
+		assert.NoError(t, env.controller.dtClient.CloseProblem(problems[notReadyKey].ProblemID, "Closed by hand"))
+		crashLoopingProblem := problems[crashLoopingKey]
+		openProblemID := crashLoopingProblem.ProblemID
+		crashLoopingProblem.ProblemID = "outdated"
+		env.problemCache.Update(cache.ProblemCache{Problems: map[string]cache.Problem{crashLoopingKey: crashLoopingProblem}})
+
+		env.scheduler.Reconcile()
+		report := env.scheduler.LastReconcile()
+		if assert.NotNil(t, report, problemsAPI) {
+			assert.Empty(t, report.Error, problemsAPI)
+			assert.Equal(t, 2, report.Checked, problemsAPI)
+			assert.Equal(t, []jobs.ReconcileChange{{Hash: notReadyKey, Title: "KubePodNotReady (critical)", ProblemID: problems[notReadyKey].ProblemID}}, report.Dropped, problemsAPI)
+			assert.Equal(t, []jobs.ReconcileChange{{Hash: crashLoopingKey, Title: "KubePodCrashLooping (critical)", ProblemID: "outdated", NewProblemID: openProblemID}}, report.Recorrelated, problemsAPI)
+		}
+		problems = env.problemCache.GetCache().Problems
+		assert.Len(t, problems, 1, problemsAPI)
+		assert.Equal(t, openProblemID, problems[crashLoopingKey].ProblemID, problemsAPI)
+
+		// The cache is not touched when Dynatrace can't be reached
+		env.dt.Fail(http.MethodGet, "/api/", http.StatusServiceUnavailable, 1)
+		crashLoopingProblem.ProblemID = "closed"
+		env.problemCache.Update(cache.ProblemCache{Problems: map[string]cache.Problem{crashLoopingKey: crashLoopingProblem}})
+		env.scheduler.Reconcile()
+		assert.NotEmpty(t, env.scheduler.LastReconcile().Error, problemsAPI)
+		assert.Len(t, env.problemCache.GetCache().Problems, 1, problemsAPI)
+	}
+}
+
+func TestReconcileConcurrentChange(t *testing.T) {
+	env := newTestEnv(t, nil)
+	problemKey := utils.Hash(`{}:{alertname="KubePodCrashLooping"}`)
+	assert.NoError(t, env.controller.SendAlerts(notification("firing", crashLooping("cart-1", "critical"))))
+	env.scheduler.UpdateProblemIDs()
+	problem := env.problemCache.GetCache().Problems[problemKey]
+	assert.NoError(t, env.controller.dtClient.CloseProblem(problem.ProblemID, "Closed by hand"))
+
+	// The problem cache is not locked while Dynatrace is called, and an entry changed meanwhile is not dropped
+	env.dt.Latency = 200 * time.Millisecond
+	reconciled := make(chan struct{})
+	go func() {
+		env.scheduler.Reconcile()
+		close(reconciled)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		env.problemCache.Lock()
+		problem.ProblemID = "reopened"
+		env.problemCache.Update(cache.ProblemCache{Problems: map[string]cache.Problem{problemKey: problem}})
+		env.problemCache.UnLock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-reconciled:
+		t.Fatal("the problem cache was locked while calling Dynatrace")
+	}
+	<-reconciled
+
+	assert.Empty(t, env.scheduler.LastReconcile().Dropped)
+	assert.Equal(t, "reopened", env.problemCache.GetCache().Problems[problemKey].ProblemID)
+}
+
+func TestDynatraceFailures(t *testing.T) {
+	env := newTestEnv(t, nil)
+
+	apiErrors := testutil.ToFloat64(metrics.APIErrors.WithLabelValues("/api/v1/events"))
+	env.dt.Fail(http.MethodPost, "/api/v1/events", http.StatusInternalServerError, 1)
+	assert.Error(t, env.controller.SendAlerts(notification("firing", crashLooping("cart-1", "critical"))))
+	assert.Empty(t, env.problemCache.GetCache().Problems)
+	assert.Equal(t, apiErrors+1, testutil.ToFloat64(metrics.APIErrors.WithLabelValues("/api/v1/events")))
+
+	// Alertmanager retries the notification
+	assert.NoError(t, env.controller.SendAlerts(notification("firing", crashLooping("cart-1", "critical"))))
+	assert.Len(t, env.problemCache.GetCache().Problems, 1)
+	env.scheduler.UpdateProblemIDs()
+
+	env.dt.Fail(http.MethodPost, "/api/v1/problem/details/", http.StatusServiceUnavailable, 1)
+	assert.Error(t, env.controller.SendAlerts(notification("resolved", crashLooping("cart-1", "critical"))))
+	assert.Len(t, env.dt.OpenProblems(), 1)
+	assert.Len(t, env.problemCache.GetCache().Problems, 1)
+
+	assert.NoError(t, env.controller.SendAlerts(notification("resolved", crashLooping("cart-1", "critical"))))
+	assert.Empty(t, env.dt.OpenProblems())
+}
+
+func TestDuplicateNotifications(t *testing.T) {
+	env := newTestEnv(t, nil)
+	problemKey := utils.Hash(`{}:{alertname="KubePodCrashLooping"}`)
+
+	duplicates := testutil.ToFloat64(metrics.DuplicateNotifications)
+	first := notification("firing", crashLooping("cart-1", "critical"))
+	assert.NoError(t, env.controller.SendAlerts(first))
+	env.scheduler.UpdateProblemIDs()
+	tracked := env.problemCache.GetCache().Problems[problemKey]
+	assert.NotEmpty(t, tracked.ProblemID)
+
+	// Alertmanager repeats the group, with a different annotation
+	repeated := notification("firing", crashLooping("cart-1", "critical"))
+	repeated.Alerts[0].Annotations["message"] = "Pod cart-1 is still crash looping"
+	assert.NoError(t, env.controller.SendAlerts(repeated))
+	assert.Len(t, env.dt.Events(), 1)
+	assert.Equal(t, duplicates+1, testutil.ToFloat64(metrics.DuplicateNotifications))
+
+	// A new alert in the group is sent, and updates the tracked problem
+	assert.NoError(t, env.controller.SendAlerts(notification("firing", crashLooping("cart-1", "critical"), crashLooping("cart-2", "critical"))))
+	assert.Len(t, env.dt.Events(), 2)
+	updated := env.problemCache.GetCache().Problems[problemKey]
+	assert.Equal(t, tracked.ProblemID, updated.ProblemID)
+	assert.True(t, updated.CreatedAt.Equal(tracked.CreatedAt))
+	assert.True(t, updated.LastSeen().After(tracked.CreatedAt))
+	assert.Len(t, updated.EventStoreResult.StoredCorrelationIds, 2)
+	assert.Len(t, updated.Alert.Alerts, 2)
+
+	// The notifications are sent again once the window is over
+	env.controller.dedup.window = 0
+	assert.NoError(t, env.controller.SendAlerts(first))
+	assert.Len(t, env.dt.Events(), 3)
+}
+
+func TestFlappingGroup(t *testing.T) {
+	env := newTestEnv(t, nil)
+	problemKey := utils.Hash(`{}:{alertname="KubePodCrashLooping"}`)
+
+	assert.NoError(t, env.controller.SendAlerts(notification("firing", crashLooping("cart-1", "critical"))))
+	env.scheduler.UpdateProblemIDs()
+	assert.NoError(t, env.controller.SendAlerts(notification("resolved", crashLooping("cart-1", "critical"))))
+	assert.NotContains(t, env.problemCache.GetCache().Problems, problemKey)
+
+	// The group fires again within the window, it is not a duplicate of the first notification
+	assert.NoError(t, env.controller.SendAlerts(notification("firing", crashLooping("cart-1", "critical"))))
+	assert.Len(t, env.dt.Events(), 2)
+	assert.Contains(t, env.problemCache.GetCache().Problems, problemKey)
+}
+
+func TestConcurrentDuplicateNotifications(t *testing.T) {
+	env := newTestEnv(t, nil)
+	// Keep the first send in flight while the copy is received
+	env.dt.Latency = 100 * time.Millisecond
+
+	data := notification("firing", crashLooping("cart-1", "critical"))
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- env.controller.SendAlerts(data) }()
+	}
+	assert.NoError(t, <-errs)
+	assert.NoError(t, <-errs)
+	assert.Len(t, env.dt.Events(), 1)
+
+	// A failed send doesn't hold its copies back
+	env.dt.Latency = 0
+	env.dt.Fail(http.MethodPost, "/api/v1/events", http.StatusInternalServerError, 1)
+	failing := notification("firing", crashLooping("cart-1", "critical"), crashLooping("cart-2", "critical"))
+	assert.Error(t, env.controller.SendAlerts(failing))
+	assert.NoError(t, env.controller.SendAlerts(failing))
+	assert.Len(t, env.dt.Events(), 2)
+}
+
+func TestDedupWindow(t *testing.T) {
+	w := newDedupWindow(time.Minute)
+	now := time.Now()
+	sent := func(groupKey string, key string, at time.Time) {
+		r, ok := w.reserve(groupKey, key, at)
+		assert.True(t, ok)
+		w.finish(r, true, at)
+	}
+	duplicate := func(groupKey string, key string, at time.Time) bool {
+		r, ok := w.reserve(groupKey, key, at)
+		if ok {
+			w.finish(r, false, at)
+		}
+		return !ok
+	}
+
+	assert.False(t, duplicate("group", "a", now))
+	sent("group", "a", now)
+	assert.True(t, duplicate("group", "a", now.Add(59*time.Second)))
+	assert.False(t, duplicate("other-group", "a", now.Add(59*time.Second)))
+	assert.False(t, duplicate("group", "a", now.Add(time.Minute)))
+	assert.Empty(t, w.sent)
+
+	// Only the last notification of the group is a duplicate
+	sent("group", "a", now)
+	sent("group", "b", now)
+	assert.False(t, duplicate("group", "a", now))
+	assert.True(t, duplicate("group", "b", now))
+
+	// A notification being sent is a duplicate until the send fails, the previous one is then the last again
+	r, ok := w.reserve("group", "c", now)
+	assert.True(t, ok)
+	assert.True(t, duplicate("group", "c", now.Add(2*time.Minute)))
+	w.finish(r, false, now)
+	assert.False(t, duplicate("group", "c", now))
+	assert.True(t, duplicate("group", "b", now))
+
+	// The order of the alerts doesn't matter
+	first, second := crashLooping("cart-1", "critical"), crashLooping("cart-2", "critical")
+	assert.Equal(t, notificationKey(notification("firing", first, second)), notificationKey(notification("firing", second, first)))
+	assert.NotEqual(t, notificationKey(notification("firing", first)), notificationKey(notification("resolved", first)))
+}
+
+func TestAlertDispatchMode(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.Dynatrace.DispatchMode = config.DispatchModeAlert
+	})
+
+	first, second := crashLooping("cart-1", "critical"), crashLooping("cart-2", "critical")
+	assert.NoError(t, env.controller.SendAlerts(notification("firing", first, second)))
+	assert.Len(t, env.dt.Events(), 2)
+	assert.Len(t, env.problemCache.GetCache().Problems, 2)
+	env.scheduler.UpdateProblemIDs()
+
+	// Only the resolved alert is closed, the group is still firing
+	data := notification("firing", first, second)
+	data.Alerts[0].Status = "resolved"
+	assert.NoError(t, env.controller.SendAlerts(data))
+	assert.Len(t, env.problemCache.GetCache().Problems, 1)
+	assert.Contains(t, env.problemCache.GetCache().Problems, second.Fingerprint)
+
+	// The second of two new alerts fails, the retry only sends that one
+	third, fourth := crashLooping("cart-3", "critical"), crashLooping("cart-4", "critical")
+	env.controller.events = &lockCheckingSender{t: t, next: env.controller.events, problemCache: env.problemCache, failAt: 2}
+	sent := len(env.dt.Events())
+	data = notification("firing", third, fourth)
+	assert.Error(t, env.controller.SendAlerts(data))
+	assert.NoError(t, env.controller.SendAlerts(data))
+	events := env.dt.Events()[sent:]
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, third.Fingerprint, events[0].Properties["Fingerprint"])
+		assert.Equal(t, fourth.Fingerprint, events[1].Properties["Fingerprint"])
+	}
+	assert.Contains(t, env.problemCache.GetCache().Problems, third.Fingerprint)
+	assert.Contains(t, env.problemCache.GetCache().Problems, fourth.Fingerprint)
+}
+
+func TestAPIv2(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.Dynatrace.EventsAPI = config.APIVersion2
+		cfg.Dynatrace.ProblemsAPI = config.APIVersion2
+		cfg.DefaultRoute.EntitySelector = `type(CLOUD_APPLICATION_NAMESPACE),entityName("{{ .Labels.namespace }}")`
+		cfg.EventTypes.Mapping = map[string]string{"critical": "ERROR_EVENT", "info": "CUSTOM_ANNOTATION"}
+	})
+	env.dt.AddEntity(fake.Entity{EntityID: "CLOUD_APPLICATION_NAMESPACE-1", DisplayName: "shop", Type: "CLOUD_APPLICATION_NAMESPACE"})
+
+	assert.NoError(t, env.controller.SendAlerts(notification("firing", crashLooping("cart-1", "critical"))))
+	sent := env.dt.Events()
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, "v2", sent[0].API)
+		assert.Equal(t, []string{"CLOUD_APPLICATION_NAMESPACE-1"}, sent[0].EntityIDs)
+	}
+
+	env.scheduler.UpdateProblemIDs()
+	for _, problem := range env.problemCache.GetCache().Problems {
+		assert.Equal(t, env.dt.OpenProblems()[0].ProblemID, problem.ProblemID)
+	}
+
+	assert.NoError(t, env.controller.SendAlerts(notification("resolved", crashLooping("cart-1", "critical"))))
+	assert.Empty(t, env.dt.OpenProblems())
+
+	// The fields of the annotations are properties in the v2 API
+	annotation := crashLooping("cart-2", "info")
+	annotation.Labels["alertname"] = "ConfigChanged"
+	data := notification("firing", annotation)
+	data.GroupKey = `{}:{alertname="ConfigChanged"}`
+	assert.NoError(t, env.controller.SendAlerts(data))
+	sent = env.dt.Events()
+	last := sent[len(sent)-1]
+	assert.Equal(t, "CUSTOM_ANNOTATION", last.EventType)
+	assert.NotEmpty(t, last.Properties["annotationType"])
+	assert.Equal(t, last.Title, last.Properties["annotationType"])
+	assert.Equal(t, last.Properties["dt.event.description"], last.Properties["annotationDescription"])
+}
@@ -0,0 +1,101 @@
+package events
+
+import (
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/apiv2"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dtclient"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/metrics"
+	dtapi "github.com/dlopes7/dynatrace-go-client/api"
+	"strconv"
+	"strings"
+)
+
+// Sender sends events to Dynatrace, using either the Events API v1 or v2
+// Events are always built as v1 EventCreation objects, which is also what the ProblemCache stores
+type Sender interface {
+	Send(event dtapi.EventCreation) (*dtapi.EventStoreResult, error)
+}
+
+// NewSender returns the Sender for the configured dynatrace.eventsAPI, dtClient is used for the v1 API
+func NewSender(cfg *config.Config, dtClient dtclient.Client) Sender {
+	if cfg.Dynatrace.EventsAPI == config.APIVersion2 {
+		return &v2Sender{client: apiv2.New(cfg)}
+	}
+	return &v1Sender{dtClient: dtClient}
+}
+
+type v1Sender struct {
+	dtClient dtclient.Client
+}
+
+func (s *v1Sender) Send(event dtapi.EventCreation) (*dtapi.EventStoreResult, error) {
+	r, err := s.dtClient.CreateEvent(event)
+	if err == nil {
+		metrics.EventsSent.WithLabelValues(string(event.EventType)).Inc()
+	}
+	return r, err
+}
+
+type v2Sender struct {
+	client *apiv2.Client
+}
+
+// v2EventTypes are the event types whose name changed in the Events API v2
+var v2EventTypes = map[string]string{
+	"RESOURCE_CONTENTION": "RESOURCE_CONTENTION_EVENT",
+}
+
+// Send translates the event to the Events API v2 format
+// The correlation IDs of the response are returned as StoredCorrelationIds, like the v1 API does
+func (s *v2Sender) Send(event dtapi.EventCreation) (*dtapi.EventStoreResult, error) {
+	eventType := string(event.EventType)
+	if v2EventType, ok := v2EventTypes[eventType]; ok {
+		eventType = v2EventType
+	}
+
+	properties := map[string]string{}
+	for key, value := range event.CustomProperties {
+		properties[key] = value
+	}
+	properties["Source"] = event.Source
+	properties["dt.event.description"] = event.Description
+	properties["dt.event.allow_davis_merge"] = strconv.FormatBool(event.AllowDavisMerge)
+	if event.DeploymentName != "" {
+		properties["dt.event.deployment.name"] = event.DeploymentName
+		properties["dt.event.deployment.version"] = event.DeploymentVersion
+	}
+	if event.AnnotationType != "" {
+		properties["annotationType"] = event.AnnotationType
+		properties["annotationDescription"] = event.AnnotationDescription
+	}
+
+	ingest := apiv2.EventIngest{
+		EventType:      eventType,
+		Title:          event.Title,
+		Timeout:        event.TimeoutMinutes,
+		EntitySelector: EntityIDSelector(event.AttachRules.EntityIds),
+		Properties:     properties,
+	}
+
+	results, err := s.client.IngestEvent(ingest)
+	if err != nil {
+		return nil, err
+	}
+
+	var correlationIDs []string
+	for _, result := range results.EventIngestResults {
+		correlationIDs = append(correlationIDs, result.CorrelationID)
+	}
+	metrics.EventsSent.WithLabelValues(string(event.EventType)).Inc()
+	return &dtapi.EventStoreResult{StoredCorrelationIds: correlationIDs}, nil
+}
+
+// EntityIDSelector returns an entity selector matching the entity IDs, ie: entityId("CUSTOM_DEVICE-1","CUSTOM_DEVICE-2")
+func EntityIDSelector(entityIDs []string) string {
+	var quoted []string
+	for _, entityID := range entityIDs {
+		quoted = append(quoted, strconv.Quote(entityID))
+	}
+	return fmt.Sprintf("entityId(%s)", strings.Join(quoted, ","))
+}
@@ -2,30 +2,38 @@ package jobs
 
 import (
 	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/apiv2"
 	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/cache"
-	dtapi "github.com/dlopes7/dynatrace-go-client/api"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dtclient"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/events"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/metrics"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/utils"
 	log "github.com/sirupsen/logrus"
-	"os"
 	"time"
 )
 
 type Scheduler struct {
-	customDeviceCache *cache.CustomDeviceCacheService
-	problemCache      *cache.ProblemCacheService
-	dtClient          dtapi.Client
+	customDeviceCache cache.DeviceStore
+	problemCache      cache.ProblemStore
+	dtClient          dtclient.Client
+	apiV2             *apiv2.Client
+	events            events.Sender
+	problemsAPI       string
+	retention         time.Duration
+	reconcileState    *reconcileState
 }
 
-func NewScheduler(deviceCache *cache.CustomDeviceCacheService, problemCache *cache.ProblemCacheService) Scheduler {
-	dt := dtapi.New(dtapi.Config{
-		APIKey:    os.Getenv("DT_API_TOKEN"),
-		BaseURL:   os.Getenv("DT_API_URL"),
-		Retries:   5,
-		RetryTime: 2 * time.Second,
-	})
+func NewScheduler(cfg *config.Config, dtClient dtclient.Client, deviceCache cache.DeviceStore, problemCache cache.ProblemStore) Scheduler {
 	return Scheduler{
-		dtClient:          dt,
+		dtClient:          dtClient,
+		apiV2:             apiv2.New(cfg),
+		events:            events.NewSender(cfg, dtClient),
+		problemsAPI:       cfg.Dynatrace.ProblemsAPI,
+		retention:         cfg.Jobs.Retention,
 		customDeviceCache: deviceCache,
 		problemCache:      problemCache,
+		reconcileState:    &reconcileState{},
 	}
 }
 
@@ -35,48 +43,168 @@ func (s *Scheduler) UpdateProblemIDs() {
 	s.problemCache.Lock()
 	problemCache := s.problemCache.GetCache()
 
-	// Copy the map so that we can update this during the iteration below
+	// Copy the map so that we can update this during the correlation below
 	updatedProblems := map[string]cache.Problem{}
 	for hash, problem := range problemCache.Problems {
 		updatedProblems[hash] = problem
 	}
 
-	dtProblems, _, err := s.dtClient.Problem.ListV1("", 0, 0, "OPEN", "", "", nil, true)
+	var err error
+	if s.problemsAPI == config.APIVersion2 {
+		err = s.correlateV2(updatedProblems)
+	} else {
+		err = s.correlateV1(updatedProblems)
+	}
 	if err != nil {
 		log.WithFields(log.Fields{"error": err.Error()}).Error("Scheduler - Error obtaining Dynatrace Problems")
 	} else {
-		for hash, problem := range problemCache.Problems {
-			foundProblem := false
-
-			if problem.ProblemID == "" {
-				// Only look for the ProblemID if we don't have it already
-
-				entity := problem.Event.AttachRules.EntityIds[0]
-				correlationID := problem.EventStoreResult.StoredCorrelationIds[0]
-				log.WithFields(log.Fields{"hash": hash, "entity": entity, "alert": problem.Event.Title, "correlationID": correlationID}).Info("Scheduler - Found an alert without a ProblemID")
-
-				// Problems V1 API gives us the correlationID for each event, we just compare the values for each event of opened problem to find ours
-				for _, dtProblem := range dtProblems {
-					for _, event := range dtProblem.RankedEvents {
-						if event.CorrelationID == correlationID {
-							log.WithFields(log.Fields{"hash": hash, "entity": entity, "problem": dtProblem.ID, "correlationID": correlationID}).Info("Scheduler - Found a ProblemID for the event")
-							problem.ProblemID = dtProblem.ID
-							updatedProblems[hash] = problem
-							foundProblem = true
-						}
+		metrics.JobLastSuccess.WithLabelValues("UpdateProblemIDs").SetToCurrentTime()
+	}
+
+	problemCache.Problems = updatedProblems
+	s.problemCache.Update(*problemCache)
+	s.problemCache.UnLock()
+
+}
+
+// correlateV1 sets the ProblemID of the problems without one, using the Problems API v1 feed of open problems
+func (s *Scheduler) correlateV1(problems map[string]cache.Problem) error {
+	dtProblems, err := s.dtClient.ListOpenProblems()
+	if err != nil {
+		return err
+	}
+
+	for hash, problem := range problems {
+		foundProblem := false
+
+		if problem.ProblemID == "" {
+			// Only look for the ProblemID if we don't have it already
+
+			entity := problem.Event.AttachRules.EntityIds[0]
+			correlationID := problem.EventStoreResult.StoredCorrelationIds[0]
+			log.WithFields(log.Fields{"hash": hash, "entity": entity, "alert": problem.Event.Title, "correlationID": correlationID}).Info("Scheduler - Found an alert without a ProblemID")
+
+			// Problems V1 API gives us the correlationID for each event, we just compare the values for each event of opened problem to find ours
+			for _, dtProblem := range dtProblems {
+				for _, eventCorrelationID := range dtProblem.CorrelationIDs {
+					if eventCorrelationID == correlationID {
+						log.WithFields(log.Fields{"hash": hash, "entity": entity, "problem": dtProblem.ID, "correlationID": correlationID}).Info("Scheduler - Found a ProblemID for the event")
+						problem.ProblemID = dtProblem.ID
+						problems[hash] = problem
+						foundProblem = true
 					}
 				}
-				if foundProblem == false {
-					log.WithFields(log.Fields{"hash": hash}).Warning("Scheduler - Could not find a Problem with an event matching the hash")
-				}
+			}
+			if foundProblem == false {
+				log.WithFields(log.Fields{"hash": hash}).Warning("Scheduler - Could not find a Problem with an event matching the hash")
 			}
 		}
 	}
+	return nil
+}
 
-	problemCache.Problems = updatedProblems
-	s.problemCache.Update(*problemCache)
-	s.problemCache.UnLock()
+// problemSelectorBatchSize is the maximum number of entities in a single problem selector, to keep the URLs short
+const problemSelectorBatchSize = 50
+
+// correlateV2 sets the ProblemID of the problems without one, using the Problems API v2
+// Only the open problems of the entities our events are attached to are requested, and their evidence is matched to our events
+func (s *Scheduler) correlateV2(problems map[string]cache.Problem) error {
+	uncorrelated := map[string]cache.Problem{}
+	for hash, problem := range problems {
+		if problem.ProblemID == "" {
+			uncorrelated[hash] = problem
+		}
+	}
+	dtProblems, err := s.listOpenProblemsV2(uncorrelated)
+	if err != nil {
+		return err
+	}
 
+	for hash, problem := range problems {
+		if problem.ProblemID != "" {
+			continue
+		}
+		log.WithFields(log.Fields{"hash": hash, "entities": problem.Event.AttachRules.EntityIds, "alert": problem.Event.Title, "correlationIDs": problem.EventStoreResult.StoredCorrelationIds}).Info("Scheduler - Found an alert without a ProblemID")
+
+		if problemID := findProblemID(problem, dtProblems); problemID != "" {
+			log.WithFields(log.Fields{"hash": hash, "problem": problemID}).Info("Scheduler - Found a ProblemID for the event")
+			problem.ProblemID = problemID
+			problems[hash] = problem
+		} else {
+			log.WithFields(log.Fields{"hash": hash}).Warning("Scheduler - Could not find a Problem with an event matching the hash")
+		}
+	}
+	return nil
+}
+
+// listOpenProblemsV2 returns the open problems of the entities the events of the problems are attached to, with their evidence
+func (s *Scheduler) listOpenProblemsV2(problems map[string]cache.Problem) ([]apiv2.Problem, error) {
+	var entityIDs []string
+	from := time.Now()
+	for _, problem := range problems {
+		for _, entityID := range problem.Event.AttachRules.EntityIds {
+			if !utils.StringInSlice(entityID, entityIDs) {
+				entityIDs = append(entityIDs, entityID)
+			}
+		}
+		if problem.CreatedAt.Before(from) {
+			from = problem.CreatedAt
+		}
+	}
+	if len(entityIDs) == 0 {
+		return nil, nil
+	}
+	// Leave some margin for clock differences between the receiver and Dynatrace
+	from = from.Add(-time.Hour)
+
+	var dtProblems []apiv2.Problem
+	for start := 0; start < len(entityIDs); start += problemSelectorBatchSize {
+		end := start + problemSelectorBatchSize
+		if end > len(entityIDs) {
+			end = len(entityIDs)
+		}
+		problemSelector := fmt.Sprintf(`status("open"),%s`, events.EntityIDSelector(entityIDs[start:end]))
+		batch, err := s.apiV2.ListProblems(problemSelector, from)
+		if err != nil {
+			return nil, err
+		}
+		dtProblems = append(dtProblems, batch...)
+	}
+	return dtProblems, nil
+}
+
+// findProblemID returns the ID of the problem having our event as evidence, or an empty string
+// Events are matched by correlation ID, or by the GroupKeyHash and Fingerprint properties we add to every event
+func findProblemID(problem cache.Problem, dtProblems []apiv2.Problem) string {
+	for _, dtProblem := range dtProblems {
+		for _, evidence := range dtProblem.EvidenceDetails.Details {
+			if evidence.EvidenceType != "EVENT" || evidence.Data == nil {
+				continue
+			}
+			if utils.StringInSlice(evidence.Data.CorrelationID, problem.EventStoreResult.StoredCorrelationIds) {
+				return dtProblem.ProblemID
+			}
+			if HasTrackingProperties(evidence.Data, problem.Event.CustomProperties) {
+				return dtProblem.ProblemID
+			}
+		}
+	}
+	return ""
+}
+
+// HasTrackingProperties returns true if the event has the same GroupKeyHash and Fingerprint properties
+func HasTrackingProperties(event *apiv2.Event, properties map[string]string) bool {
+	for _, key := range []string{"GroupKeyHash", "Fingerprint"} {
+		expected, ok := properties[key]
+		if !ok {
+			continue
+		}
+		if value, _ := event.Property(key); value != expected {
+			return false
+		}
+	}
+	_, hasGroupKeyHash := properties["GroupKeyHash"]
+	return hasGroupKeyHash
 }
 
 func (s *Scheduler) ResendEvents() {
@@ -84,14 +212,19 @@ func (s *Scheduler) ResendEvents() {
 	log.Info("Scheduler - Starting ResendEvents")
 	s.problemCache.Lock()
 	problemCache := s.problemCache.GetCache()
+	failed := false
 	for _, problem := range problemCache.Problems {
-		r, _, err := s.dtClient.Events.Create(problem.Event)
+		r, err := s.events.Send(problem.Event)
 		if err != nil {
 			log.WithFields(log.Fields{"error": err.Error()}).Error("Scheduler - Could not resent the event")
+			failed = true
 		}
 		log.WithFields(log.Fields{"response": fmt.Sprintf("%+v", r)}).Info("Scheduler - Dynatrace response after sending the event")
 	}
 	s.problemCache.UnLock()
+	if !failed {
+		metrics.JobLastSuccess.WithLabelValues("ResendEvents").SetToCurrentTime()
+	}
 
 }
 
@@ -102,11 +235,13 @@ func (s *Scheduler) DeleteOldEvents() {
 	s.problemCache.Lock()
 	problemCache := s.problemCache.GetCache()
 	for hash, problem := range problemCache.Problems {
-		timeAlive := now.Sub(problem.CreatedAt)
-		if timeAlive > 5*24*time.Hour {
-			log.WithFields(log.Fields{"CreatedAt": problem.CreatedAt, "timeAlive": timeAlive}).Info("Scheduler - Deleting event because it is too old")
+		// Problems still updated by Alertmanager notifications are kept
+		timeAlive := now.Sub(problem.LastSeen())
+		if timeAlive > s.retention {
+			log.WithFields(log.Fields{"CreatedAt": problem.CreatedAt, "UpdatedAt": problem.UpdatedAt, "timeAlive": timeAlive}).Info("Scheduler - Deleting event because it is too old")
 			s.problemCache.Delete(hash)
 		}
 	}
 	s.problemCache.UnLock()
+	metrics.JobLastSuccess.WithLabelValues("DeleteOldEvents").SetToCurrentTime()
 }
@@ -0,0 +1,73 @@
+package jobs
+
+import (
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/apiv2"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/cache"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dtclient"
+	dtapi "github.com/dlopes7/dynatrace-go-client/api"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestScheduler(t *testing.T) (Scheduler, cache.ProblemStore) {
+	cfg := config.Default()
+	cfg.Dynatrace.APIURL = "http://localhost"
+	cfg.Dynatrace.APIToken = "my-token"
+	cfg.Cache.Backend = config.CacheBackendMemory
+
+	storage, err := cache.OpenStorage(cfg)
+	assert.NoError(t, err)
+	deviceCache := cache.NewCustomDeviceCacheService(cfg, storage)
+	problemCache := cache.NewProblemCacheService(storage)
+	return NewScheduler(cfg, dtclient.New(cfg), &deviceCache, &problemCache), &problemCache
+}
+
+func TestDeleteOldEvents(t *testing.T) {
+	scheduler, problemCache := newTestScheduler(t)
+	problemCache.AddProblem("old", cache.Problem{CreatedAt: time.Now().Add(-6 * 24 * time.Hour)})
+	problemCache.AddProblem("recent", cache.Problem{CreatedAt: time.Now().Add(-time.Hour)})
+
+	scheduler.DeleteOldEvents()
+
+	problems := problemCache.GetCache().Problems
+	assert.Len(t, problems, 1)
+	assert.Contains(t, problems, "recent")
+
+	// The retention is configurable, and counts from the last update
+	scheduler.retention = 30 * time.Minute
+	problemCache.AddProblem("updated", cache.Problem{CreatedAt: time.Now().Add(-time.Hour), UpdatedAt: time.Now()})
+	scheduler.DeleteOldEvents()
+	problems = problemCache.GetCache().Problems
+	assert.Len(t, problems, 1)
+	assert.Contains(t, problems, "updated")
+}
+
+func TestFindProblemID(t *testing.T) {
+	problem := cache.Problem{
+		Event: dtapi.EventCreation{
+			CustomProperties: map[string]string{"GroupKeyHash": "abc", "Fingerprint": "f1"},
+		},
+		EventStoreResult: dtapi.EventStoreResult{StoredCorrelationIds: []string{"c1"}},
+	}
+	eventEvidence := func(correlationID string, properties ...apiv2.EventProperty) apiv2.Evidence {
+		return apiv2.Evidence{EvidenceType: "EVENT", Data: &apiv2.Event{CorrelationID: correlationID, Properties: properties}}
+	}
+	dtProblems := []apiv2.Problem{
+		{ProblemID: "P-1", EvidenceDetails: apiv2.EvidenceDetails{Details: []apiv2.Evidence{eventEvidence("other")}}},
+		{ProblemID: "P-2", EvidenceDetails: apiv2.EvidenceDetails{Details: []apiv2.Evidence{eventEvidence("c1")}}},
+	}
+	assert.Equal(t, "P-2", findProblemID(problem, dtProblems))
+
+	// Events are also found by their tracking properties, ie: after being resent with a new correlation ID
+	dtProblems = []apiv2.Problem{
+		{ProblemID: "P-3", EvidenceDetails: apiv2.EvidenceDetails{Details: []apiv2.Evidence{
+			eventEvidence("c2", apiv2.EventProperty{Key: "GroupKeyHash", Value: "abc"}, apiv2.EventProperty{Key: "Fingerprint", Value: "f2"}),
+			eventEvidence("c3", apiv2.EventProperty{Key: "GroupKeyHash", Value: "abc"}, apiv2.EventProperty{Key: "Fingerprint", Value: "f1"}),
+		}}},
+	}
+	assert.Equal(t, "P-3", findProblemID(problem, dtProblems))
+
+	assert.Equal(t, "", findProblemID(problem, nil))
+}
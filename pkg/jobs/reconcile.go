@@ -0,0 +1,184 @@
+package jobs
+
+import (
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/cache"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/metrics"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReconcileChange is a ProblemCache entry changed by Reconcile
+type ReconcileChange struct {
+	Hash      string `json:"hash"`
+	Title     string `json:"title"`
+	ProblemID string `json:"problemID"`
+	// NewProblemID is the open problem now having our events as evidence, it is empty for the dropped entries
+	NewProblemID string `json:"newProblemID,omitempty"`
+}
+
+// ReconcileReport is the difference between the ProblemCache and the open problems in Dynatrace found by Reconcile
+type ReconcileReport struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	// Checked is the number of cached problems with a ProblemID, the others are correlated by UpdateProblemIDs
+	Checked int `json:"checked"`
+	// Dropped are the entries whose problem is closed in Dynatrace, they were deleted from the cache
+	Dropped []ReconcileChange `json:"dropped"`
+	// Recorrelated are the entries whose events are now evidence of another open problem
+	Recorrelated []ReconcileChange `json:"recorrelated"`
+	// Error is set if the problems could not be listed, the cache is then left untouched
+	Error string `json:"error,omitempty"`
+}
+
+// reconcileState keeps the last report, it is shared by the copies of the Scheduler
+type reconcileState struct {
+	lock sync.Mutex
+	last *ReconcileReport
+}
+
+// Reconcile compares the ProblemCache with the open problems in Dynatrace
+// Entries whose problem was closed (ie: by hand) are dropped, so that ResendEvents doesn't reopen them, and entries whose events
+// are now evidence of another problem are updated with its ProblemID
+func (s *Scheduler) Reconcile() {
+	log.Info("Scheduler - Starting Reconcile")
+	report := &ReconcileReport{StartedAt: time.Now(), Dropped: []ReconcileChange{}, Recorrelated: []ReconcileChange{}}
+
+	// Dynatrace is called without holding the lock, so that the notifications are not blocked meanwhile
+	s.problemCache.Lock()
+	correlated := map[string]cache.Problem{}
+	for hash, problem := range s.problemCache.GetCache().Problems {
+		if problem.ProblemID != "" {
+			correlated[hash] = problem
+		}
+	}
+	s.problemCache.UnLock()
+	report.Checked = len(correlated)
+
+	err := s.reconcile(correlated, report)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Scheduler - Error obtaining Dynatrace Problems, the cache was not reconciled")
+		report.Error = err.Error()
+	} else {
+		s.problemCache.Lock()
+		current := s.problemCache.GetCache().Problems
+		// unchanged returns true if the entry still has the ProblemID it was reconciled with, it was not resolved or correlated meanwhile
+		unchanged := func(change ReconcileChange) bool {
+			problem, ok := current[change.Hash]
+			return ok && problem.ProblemID == change.ProblemID
+		}
+
+		dropped := []ReconcileChange{}
+		for _, change := range report.Dropped {
+			if !unchanged(change) {
+				continue
+			}
+			log.WithFields(log.Fields{"hash": change.Hash, "problem": change.ProblemID, "alert": change.Title}).Info("Scheduler - The problem is closed in Dynatrace, dropping it from the cache")
+			s.problemCache.Delete(change.Hash)
+			dropped = append(dropped, change)
+		}
+		recorrelated := []ReconcileChange{}
+		updated := map[string]cache.Problem{}
+		for _, change := range report.Recorrelated {
+			if !unchanged(change) {
+				continue
+			}
+			log.WithFields(log.Fields{"hash": change.Hash, "problem": change.ProblemID, "newProblem": change.NewProblemID, "alert": change.Title}).Info("Scheduler - The events are evidence of another problem, updating the ProblemID")
+			problem := current[change.Hash]
+			problem.ProblemID = change.NewProblemID
+			updated[change.Hash] = problem
+			recorrelated = append(recorrelated, change)
+		}
+		if len(updated) > 0 {
+			s.problemCache.Update(cache.ProblemCache{Problems: updated})
+		}
+		s.problemCache.UnLock()
+
+		report.Dropped, report.Recorrelated = dropped, recorrelated
+		metrics.JobLastSuccess.WithLabelValues("Reconcile").SetToCurrentTime()
+	}
+
+	report.FinishedAt = time.Now()
+	log.WithFields(log.Fields{"checked": report.Checked, "dropped": len(report.Dropped), "recorrelated": len(report.Recorrelated)}).Info("Scheduler - Finished Reconcile")
+
+	s.reconcileState.lock.Lock()
+	s.reconcileState.last = report
+	s.reconcileState.lock.Unlock()
+}
+
+// LastReconcile returns the report of the last Reconcile, or nil if it never ran
+func (s *Scheduler) LastReconcile() *ReconcileReport {
+	s.reconcileState.lock.Lock()
+	defer s.reconcileState.lock.Unlock()
+	return s.reconcileState.last
+}
+
+// reconcile fills the report with the changes between the problems and the open problems in Dynatrace
+func (s *Scheduler) reconcile(problems map[string]cache.Problem, report *ReconcileReport) error {
+	if len(problems) == 0 {
+		return nil
+	}
+
+	// isOpen returns true if the problem is still open, findOpen returns the open problem having the events of problem as evidence
+	var isOpen func(problemID string) bool
+	var findOpen func(problem cache.Problem) string
+
+	if s.problemsAPI == config.APIVersion2 {
+		dtProblems, err := s.listOpenProblemsV2(problems)
+		if err != nil {
+			return err
+		}
+		isOpen = func(problemID string) bool {
+			for _, dtProblem := range dtProblems {
+				if dtProblem.ProblemID == problemID {
+					return true
+				}
+			}
+			return false
+		}
+		findOpen = func(problem cache.Problem) string {
+			return findProblemID(problem, dtProblems)
+		}
+	} else {
+		dtProblems, err := s.dtClient.ListOpenProblems()
+		if err != nil {
+			return err
+		}
+		isOpen = func(problemID string) bool {
+			for _, dtProblem := range dtProblems {
+				if dtProblem.ID == problemID {
+					return true
+				}
+			}
+			return false
+		}
+		findOpen = func(problem cache.Problem) string {
+			for _, dtProblem := range dtProblems {
+				for _, correlationID := range dtProblem.CorrelationIDs {
+					if utils.StringInSlice(correlationID, problem.EventStoreResult.StoredCorrelationIds) {
+						return dtProblem.ID
+					}
+				}
+			}
+			return ""
+		}
+	}
+
+	for hash, problem := range problems {
+		if isOpen(problem.ProblemID) {
+			continue
+		}
+		change := ReconcileChange{Hash: hash, Title: problem.Event.Title, ProblemID: problem.ProblemID}
+		if change.NewProblemID = findOpen(problem); change.NewProblemID != "" {
+			report.Recorrelated = append(report.Recorrelated, change)
+		} else {
+			report.Dropped = append(report.Dropped, change)
+		}
+	}
+	sort.Slice(report.Dropped, func(i, j int) bool { return report.Dropped[i].Hash < report.Dropped[j].Hash })
+	sort.Slice(report.Recorrelated, func(i, j int) bool { return report.Recorrelated[i].Hash < report.Recorrelated[j].Hash })
+	return nil
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+const namespace = "dynatrace_receiver"
+
+var (
+	NotificationsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_received_total",
+		Help:      "Alertmanager notifications received, by status",
+	}, []string{"status"})
+
+	DuplicateNotifications = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "duplicate_notifications_total",
+		Help:      "Notifications acknowledged without calling Dynatrace because they were already sent within the dedup window",
+	})
+
+	AuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_auth_failures_total",
+		Help:      "Requests to the webhook rejected because of missing or invalid credentials, by reason",
+	}, []string{"reason"})
+
+	EventsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_sent_total",
+		Help:      "Events sent to Dynatrace, by event type",
+	}, []string{"event_type"})
+
+	APIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_errors_total",
+		Help:      "Failed Dynatrace API calls, by endpoint",
+	}, []string{"endpoint"})
+
+	APIRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Duration of the Dynatrace API calls, by endpoint, including the retries",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	SendAlertsDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "send_alerts_duration_seconds",
+		Help:      "Time spent sending a notification to Dynatrace",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	})
+
+	JobLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "job_last_success_timestamp_seconds",
+		Help:      "Last time the scheduled job completed successfully, by job",
+	}, []string{"job"})
+)
+
+// ObserveAPICall records the duration of a Dynatrace API call started at start, and counts it as an error if err is not nil
+// Endpoints are the API paths with their parameters replaced by placeholders, ie: /api/v2/entities/{id}
+func ObserveAPICall(endpoint string, start time.Time, err error) {
+	APIRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		APIErrors.WithLabelValues(endpoint).Inc()
+	}
+}
+
+// RegisterCacheGauges exposes the size of the caches, the functions are called on every scrape
+func RegisterCacheGauges(problems func() int, problemsWithoutID func() int, customDevices func() int) {
+	gauges := []struct {
+		name string
+		help string
+		f    func() int
+	}{
+		{"problem_cache_entries", "Problems in the problem cache", problems},
+		{"problem_cache_entries_without_problem_id", "Problems in the problem cache still waiting for their Dynatrace ProblemID", problemsWithoutID},
+		{"custom_device_cache_entries", "Custom Devices in the custom device cache", customDevices},
+	}
+	for _, gauge := range gauges {
+		f := gauge.f
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      gauge.name,
+			Help:      gauge.help,
+		}, func() float64 { return float64(f()) })
+	}
+}
@@ -0,0 +1,287 @@
+package queue
+
+import (
+	"context"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
+	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// workerBacklog is the number of entries buffered per worker, the entries beyond it are read back from the queue by the worker
+const workerBacklog = 1000
+
+// SendFunc sends a notification to Dynatrace
+type SendFunc func(data alertmanager.Data) error
+
+// Dispatcher sends the queued notifications with a pool of workers
+// Notifications with the same groupKey always go to the same worker, so they are sent in the order they were received
+type Dispatcher struct {
+	queue         *Queue
+	send          SendFunc
+	workers       []chan Entry
+	maxRetries    int
+	retryInterval time.Duration
+
+	// overflowed is true for the workers whose channel was full, their next entries are only in the queue
+	// The worker reads them back from the queue once its channel is empty
+	lock       sync.Mutex
+	overflowed []bool
+
+	// stop is closed by Stop, the workers exit after their current notification
+	stop    chan struct{}
+	running sync.WaitGroup
+	// closed is closed once the queue is closed, after the workers exited
+	closed chan struct{}
+}
+
+func NewDispatcher(queue *Queue, send SendFunc, workers int, maxRetries int, retryInterval time.Duration) *Dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	d := &Dispatcher{
+		queue:         queue,
+		send:          send,
+		workers:       make([]chan Entry, workers),
+		maxRetries:    maxRetries,
+		retryInterval: retryInterval,
+		overflowed:    make([]bool, workers),
+		stop:          make(chan struct{}),
+		closed:        make(chan struct{}),
+	}
+	for i := range d.workers {
+		d.workers[i] = make(chan Entry, workerBacklog)
+	}
+	return d
+}
+
+// Start starts the workers and replays the entries left in the queue by a previous run
+func (d *Dispatcher) Start() {
+	for i, entries := range d.workers {
+		d.running.Add(1)
+		go d.work(i, entries)
+	}
+
+	pending := d.queue.Pending()
+	if len(pending) > 0 {
+		log.WithFields(log.Fields{"pending": len(pending)}).Info("Queue - Replaying the pending notifications")
+	}
+	for _, entry := range pending {
+		d.dispatch(entry)
+	}
+}
+
+// Enqueue persists the notification and hands it to its worker, the notification is safe once Enqueue returns
+// It never waits for the workers, so that Alertmanager is answered right away even if Dynatrace is slow
+func (d *Dispatcher) Enqueue(data alertmanager.Data) error {
+	entry, err := d.queue.Put(data)
+	if err != nil {
+		return err
+	}
+	d.dispatch(entry)
+	return nil
+}
+
+// dispatch hands the entry to its worker without blocking, the entry stays in the queue only if the worker's channel is full
+func (d *Dispatcher) dispatch(entry Entry) {
+	worker := d.workerFor(entry.Data.GroupKey)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.overflowed[worker] {
+		return
+	}
+	select {
+	case d.workers[worker] <- entry:
+	default:
+		log.WithFields(log.Fields{"worker": worker, "backlog": workerBacklog}).Warning("Queue - The worker is busy, the next notifications will be read back from the queue")
+		d.overflowed[worker] = true
+	}
+}
+
+func (d *Dispatcher) workerFor(groupKey string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(groupKey))
+	return int(h.Sum32() % uint32(len(d.workers)))
+}
+
+// overflow returns the entries of the worker that are only in the queue, if its channel overflowed
+// Entries added from now on go through the channel again, some of them can be returned here too, the worker skips them by Seq
+func (d *Dispatcher) overflow(worker int) []Entry {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.overflowed[worker] {
+		return nil
+	}
+	d.overflowed[worker] = false
+
+	var entries []Entry
+	for _, entry := range d.queue.Pending() {
+		if d.workerFor(entry.Data.GroupKey) == worker {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Stop waits for the workers to finish the notification they are sending, and closes the queue
+// The notifications that were not sent yet stay in the queue, they are replayed on the next start
+// Enqueue must not be called anymore, it returns false if the workers were still busy when ctx is done: the queue is then
+// closed once they finish, so that the notification they were sending is still acknowledged
+func (d *Dispatcher) Stop(ctx context.Context) bool {
+	close(d.stop)
+
+	go func() {
+		d.running.Wait()
+		if err := d.queue.Close(); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Queue - Could not close the queue")
+		}
+		close(d.closed)
+	}()
+
+	stopped := true
+	select {
+	case <-d.closed:
+	case <-ctx.Done():
+		stopped = false
+	}
+	log.WithFields(log.Fields{"pending": d.queue.Len(), "stopped": stopped}).Info("Queue - Stopped the dispatcher")
+	return stopped
+}
+
+// retry is a notification waiting to be sent again, with the notifications of the same groupKey received after it
+type retry struct {
+	entries []Entry
+	// failures is the number of failed attempts of the first entry
+	failures int
+	next     time.Time
+}
+
+// work sends the entries of a worker
+// A notification that fails waits for its retry without blocking the worker: the worker goes on with the other groups,
+// and the notifications of the same groupKey are held behind it to keep their order
+// Once its channel is empty, the worker reads back the entries that overflowed it from the queue
+func (d *Dispatcher) work(worker int, entries chan Entry) {
+	defer d.running.Done()
+
+	retries := map[string]*retry{}
+	// replayed are the entries read back from the queue, the entries added while they were read can also be in the channel
+	replayed := map[uint64]bool{}
+	receive := func(entry Entry) {
+		if r, ok := retries[entry.Data.GroupKey]; ok {
+			r.entries = append(r.entries, entry)
+			return
+		}
+		d.process(worker, []Entry{entry}, 0, retries)
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		// Check stop first, select picks randomly when both are ready
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+
+		if len(entries) == 0 {
+			if overflow := d.overflow(worker); overflow != nil {
+				// The entries waiting for a retry are pending too
+				replayed = map[uint64]bool{}
+				for _, r := range retries {
+					for _, entry := range r.entries {
+						replayed[entry.Seq] = true
+					}
+				}
+				for _, entry := range overflow {
+					if replayed[entry.Seq] {
+						continue
+					}
+					select {
+					case <-d.stop:
+						return
+					default:
+					}
+					replayed[entry.Seq] = true
+					receive(entry)
+				}
+			}
+		}
+
+		var retryC <-chan time.Time
+		if next, ok := nextRetry(retries); ok {
+			resetTimer(timer, time.Until(next))
+			retryC = timer.C
+		}
+
+		select {
+		case <-d.stop:
+			// The notifications waiting for a retry stay in the queue, they are sent after the restart
+			return
+		case entry := <-entries:
+			if replayed[entry.Seq] {
+				delete(replayed, entry.Seq)
+				continue
+			}
+			receive(entry)
+		case <-retryC:
+			now := time.Now()
+			for groupKey, r := range retries {
+				if !now.Before(r.next) {
+					delete(retries, groupKey)
+					d.process(worker, r.entries, r.failures, retries)
+				}
+			}
+		}
+	}
+}
+
+// process sends the entries of a groupKey in order, and removes them from the queue
+// failures is the number of failed attempts of the first entry, if an entry fails it is added to retries with the entries after it
+// Entries that still fail after maxRetries are dropped so they don't block the other notifications of their group
+func (d *Dispatcher) process(worker int, entries []Entry, failures int, retries map[string]*retry) {
+	for i, entry := range entries {
+		fields := log.Fields{"worker": worker, "seq": entry.Seq, "groupKey": entry.Data.GroupKey}
+		if i > 0 {
+			failures = 0
+		}
+
+		if err := d.send(entry.Data); err != nil {
+			failures++
+			if failures <= d.maxRetries {
+				log.WithFields(fields).WithFields(log.Fields{"attempt": failures, "retryInterval": d.retryInterval, "error": err.Error()}).Warning("Queue - Could not send the notification, will retry")
+				retries[entry.Data.GroupKey] = &retry{entries: entries[i:], failures: failures, next: time.Now().Add(d.retryInterval)}
+				return
+			}
+			log.WithFields(fields).WithFields(log.Fields{"attempts": failures, "error": err.Error()}).Error("Queue - Dropping the notification, could not send it to Dynatrace")
+		}
+
+		if err := d.queue.Ack(entry.Seq); err != nil {
+			log.WithFields(fields).WithFields(log.Fields{"error": err.Error()}).Error("Queue - Could not acknowledge the notification")
+		}
+	}
+}
+
+// nextRetry returns the time of the earliest retry, false if nothing is waiting
+func nextRetry(retries map[string]*retry) (time.Time, bool) {
+	var next time.Time
+	for _, r := range retries {
+		if next.IsZero() || r.next.Before(next) {
+			next = r.next
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// resetTimer resets a timer which may have fired without its channel being read
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
@@ -0,0 +1,242 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	opPut = "put"
+	opAck = "ack"
+
+	// compactThreshold is the number of acknowledged entries after which the log is rewritten with the pending entries only
+	compactThreshold = 1000
+)
+
+// Entry is a notification waiting to be sent to Dynatrace
+type Entry struct {
+	Seq        uint64            `json:"seq"`
+	ReceivedAt time.Time         `json:"receivedAt"`
+	Data       alertmanager.Data `json:"data"`
+}
+
+// record is a line of the log, either a new entry or the acknowledgement of an entry
+type record struct {
+	Op         string             `json:"op"`
+	Seq        uint64             `json:"seq"`
+	ReceivedAt time.Time          `json:"receivedAt,omitempty"`
+	Data       *alertmanager.Data `json:"data,omitempty"`
+}
+
+// Queue is a durable FIFO of notifications, backed by an append-only log (write-ahead log) on disk
+// Every Put and Ack is synced to disk before returning, so pending entries survive a crash or a restart
+type Queue struct {
+	lock     sync.Mutex
+	location string
+	file     *os.File
+	pending  map[uint64]Entry
+	nextSeq  uint64
+	acked    int
+}
+
+// Open opens the queue log in the directory, creating it if needed, and loads the pending entries
+func Open(directory string) (*Queue, error) {
+	if err := os.MkdirAll(directory, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("could not create the queue directory %s: %s", directory, err.Error())
+	}
+
+	q := &Queue{
+		location: path.Join(directory, "queue.log"),
+		pending:  map[uint64]Entry{},
+		nextSeq:  1,
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	// Start from a clean log containing only the pending entries
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{"location": q.location, "pending": len(q.pending)}).Info("Queue - Opened the queue")
+	return q, nil
+}
+
+func (q *Queue) load() error {
+	file, err := os.Open(q.location)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not open the queue log %s: %s", q.location, err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// This can only be the last line, when we crashed in the middle of a write. That entry was never acknowledged to Alertmanager
+			log.WithFields(log.Fields{"location": q.location, "line": line, "error": err.Error()}).Warning("Queue - Ignoring a corrupted record")
+			continue
+		}
+		switch r.Op {
+		case opPut:
+			if r.Data != nil {
+				q.pending[r.Seq] = Entry{Seq: r.Seq, ReceivedAt: r.ReceivedAt, Data: *r.Data}
+			}
+		case opAck:
+			delete(q.pending, r.Seq)
+		}
+		if r.Seq >= q.nextSeq {
+			q.nextSeq = r.Seq + 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read the queue log %s: %s", q.location, err.Error())
+	}
+	return nil
+}
+
+// compact rewrites the log with the pending entries only, and reopens it for appending
+// The new log is written next to the current one and renamed, so a crash leaves either the old or the new log
+func (q *Queue) compact() error {
+	if q.file != nil {
+		q.file.Close()
+		q.file = nil
+	}
+
+	tmpLocation := q.location + ".tmp"
+	tmp, err := os.OpenFile(tmpLocation, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not create the queue log %s: %s", tmpLocation, err.Error())
+	}
+	for _, entry := range q.pendingLocked() {
+		data := entry.Data
+		if err := writeRecord(tmp, record{Op: opPut, Seq: entry.Seq, ReceivedAt: entry.ReceivedAt, Data: &data}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not sync the queue log %s: %s", tmpLocation, err.Error())
+	}
+	tmp.Close()
+	if err := os.Rename(tmpLocation, q.location); err != nil {
+		return fmt.Errorf("could not replace the queue log %s: %s", q.location, err.Error())
+	}
+
+	q.file, err = os.OpenFile(q.location, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open the queue log %s: %s", q.location, err.Error())
+	}
+	q.acked = 0
+	return nil
+}
+
+func writeRecord(file *os.File, r record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("could not write to the queue log: %s", err.Error())
+	}
+	return nil
+}
+
+// append writes a record to the log and syncs it to disk
+func (q *Queue) append(r record) error {
+	if q.file == nil {
+		return fmt.Errorf("the queue is closed")
+	}
+	if err := writeRecord(q.file, r); err != nil {
+		return err
+	}
+	if err := q.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync the queue log: %s", err.Error())
+	}
+	return nil
+}
+
+// Put adds a notification to the queue, once it returns the notification is on disk
+func (q *Queue) Put(data alertmanager.Data) (Entry, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	entry := Entry{Seq: q.nextSeq, ReceivedAt: time.Now(), Data: data}
+	if err := q.append(record{Op: opPut, Seq: entry.Seq, ReceivedAt: entry.ReceivedAt, Data: &data}); err != nil {
+		return Entry{}, err
+	}
+	q.nextSeq++
+	q.pending[entry.Seq] = entry
+	return entry, nil
+}
+
+// Ack removes an entry from the queue, once it has been processed
+func (q *Queue) Ack(seq uint64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if _, ok := q.pending[seq]; !ok {
+		return nil
+	}
+	if err := q.append(record{Op: opAck, Seq: seq}); err != nil {
+		return err
+	}
+	delete(q.pending, seq)
+	q.acked++
+
+	if len(q.pending) == 0 || q.acked >= compactThreshold {
+		return q.compact()
+	}
+	return nil
+}
+
+// Pending returns the entries that have not been acknowledged yet, in the order they were received
+func (q *Queue) Pending() []Entry {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.pendingLocked()
+}
+
+func (q *Queue) pendingLocked() []Entry {
+	entries := make([]Entry, 0, len(q.pending))
+	for _, entry := range q.pending {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	return entries
+}
+
+// Len returns the number of pending entries
+func (q *Queue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.pending)
+}
+
+// Close closes the log, the pending entries are replayed the next time the queue is opened
+func (q *Queue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
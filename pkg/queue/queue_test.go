@@ -0,0 +1,260 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueReplay(t *testing.T) {
+	directory := t.TempDir()
+
+	q, err := Open(directory)
+	assert.NoError(t, err)
+	first, _ := q.Put(alertmanager.Data{GroupKey: "a", Status: "firing"})
+	second, _ := q.Put(alertmanager.Data{GroupKey: "b", Status: "firing"})
+	_, _ = q.Put(alertmanager.Data{GroupKey: "a", Status: "resolved"})
+	assert.NoError(t, q.Ack(second.Seq))
+	assert.NoError(t, q.Close())
+
+	// Simulate a crash in the middle of a write
+	file, _ := os.OpenFile(path.Join(directory, "queue.log"), os.O_APPEND|os.O_WRONLY, 0644)
+	_, _ = file.WriteString(`{"op":"put","seq":4,"data":{"groupKey"`)
+	file.Close()
+
+	q, err = Open(directory)
+	assert.NoError(t, err)
+	pending := q.Pending()
+	if assert.Len(t, pending, 2) {
+		assert.Equal(t, first.Seq, pending[0].Seq)
+		assert.Equal(t, "firing", pending[0].Data.Status)
+		assert.Equal(t, "resolved", pending[1].Data.Status)
+	}
+
+	// New entries never reuse a sequence number
+	entry, _ := q.Put(alertmanager.Data{GroupKey: "c"})
+	assert.Equal(t, uint64(4), entry.Seq)
+
+	for _, entry := range q.Pending() {
+		assert.NoError(t, q.Ack(entry.Seq))
+	}
+	assert.Equal(t, 0, q.Len())
+	content, _ := ioutil.ReadFile(path.Join(directory, "queue.log"))
+	assert.Empty(t, content)
+	assert.NoError(t, q.Close())
+}
+
+func TestDispatcherOrder(t *testing.T) {
+	q, err := Open(t.TempDir())
+	assert.NoError(t, err)
+	defer q.Close()
+
+	var lock sync.Mutex
+	sent := map[string][]string{}
+	failures := 1
+	done := make(chan struct{}, 20)
+	send := func(data alertmanager.Data) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if failures > 0 {
+			failures--
+			return fmt.Errorf("temporary error")
+		}
+		sent[data.GroupKey] = append(sent[data.GroupKey], data.Status)
+		done <- struct{}{}
+		return nil
+	}
+
+	d := NewDispatcher(q, send, 4, 1, time.Millisecond)
+	d.Start()
+	for i := 0; i < 10; i++ {
+		groupKey := fmt.Sprintf("group-%d", i%2)
+		assert.NoError(t, d.Enqueue(alertmanager.Data{GroupKey: groupKey, Status: fmt.Sprintf("%d", i)}))
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the notifications")
+		}
+	}
+
+	lock.Lock()
+	assert.Equal(t, []string{"0", "2", "4", "6", "8"}, sent["group-0"])
+	assert.Equal(t, []string{"1", "3", "5", "7", "9"}, sent["group-1"])
+	lock.Unlock()
+
+	assert.Eventually(t, func() bool { return q.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDispatcherStop(t *testing.T) {
+	directory := t.TempDir()
+	q, err := Open(directory)
+	assert.NoError(t, err)
+
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	send := func(data alertmanager.Data) error {
+		if data.Status == "firing" {
+			close(sending)
+			<-release
+		}
+		return nil
+	}
+
+	d := NewDispatcher(q, send, 1, 0, time.Millisecond)
+	d.Start()
+	assert.NoError(t, d.Enqueue(alertmanager.Data{GroupKey: "a", Status: "firing"}))
+	assert.NoError(t, d.Enqueue(alertmanager.Data{GroupKey: "a", Status: "resolved"}))
+	<-sending
+
+	// The notification being sent is finished, the next one stays in the queue
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.True(t, d.Stop(ctx))
+
+	q, err = Open(directory)
+	assert.NoError(t, err)
+	pending := q.Pending()
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, "resolved", pending[0].Data.Status)
+	}
+	assert.NoError(t, q.Close())
+}
+
+func TestDispatcherRetryDoesNotBlock(t *testing.T) {
+	directory := t.TempDir()
+	q, err := Open(directory)
+	assert.NoError(t, err)
+
+	sent := make(chan string, 10)
+	send := func(data alertmanager.Data) error {
+		if data.GroupKey == "failing" {
+			return fmt.Errorf("temporary error")
+		}
+		sent <- data.GroupKey
+		return nil
+	}
+
+	// A single worker, the failing group waits for its retry without blocking the other group
+	d := NewDispatcher(q, send, 1, 5, time.Hour)
+	d.Start()
+	assert.NoError(t, d.Enqueue(alertmanager.Data{GroupKey: "failing", Status: "firing"}))
+	assert.NoError(t, d.Enqueue(alertmanager.Data{GroupKey: "failing", Status: "resolved"}))
+	assert.NoError(t, d.Enqueue(alertmanager.Data{GroupKey: "other", Status: "firing"}))
+	select {
+	case groupKey := <-sent:
+		assert.Equal(t, "other", groupKey)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the worker is blocked by the failing notification")
+	}
+
+	// The failing group keeps its order in the queue
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.True(t, d.Stop(ctx))
+	q, err = Open(directory)
+	assert.NoError(t, err)
+	pending := q.Pending()
+	if assert.Len(t, pending, 2) {
+		assert.Equal(t, "firing", pending[0].Data.Status)
+		assert.Equal(t, "resolved", pending[1].Data.Status)
+	}
+	assert.NoError(t, q.Close())
+}
+
+func TestDispatcherOverflow(t *testing.T) {
+	q, err := Open(t.TempDir())
+	assert.NoError(t, err)
+	defer q.Close()
+
+	release := make(chan struct{})
+	sent := make(chan string, 10)
+	send := func(data alertmanager.Data) error {
+		<-release
+		sent <- data.Status
+		return nil
+	}
+
+	// The worker is busy and its channel holds a single entry, the other entries stay in the queue
+	d := NewDispatcher(q, send, 1, 0, time.Millisecond)
+	d.workers[0] = make(chan Entry, 1)
+	d.Start()
+	enqueued := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, d.Enqueue(alertmanager.Data{GroupKey: "a", Status: fmt.Sprintf("%d", i)}))
+		}
+		close(enqueued)
+	}()
+	select {
+	case <-enqueued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Enqueue is blocked by the busy worker")
+	}
+
+	close(release)
+	var statuses []string
+	for i := 0; i < 5; i++ {
+		select {
+		case status := <-sent:
+			statuses = append(statuses, status)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the notifications")
+		}
+	}
+	assert.Equal(t, []string{"0", "1", "2", "3", "4"}, statuses)
+	assert.Eventually(t, func() bool { return q.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.True(t, d.Stop(ctx))
+	assert.Empty(t, sent)
+}
+
+func TestDispatcherStopTimeout(t *testing.T) {
+	directory := t.TempDir()
+	q, err := Open(directory)
+	assert.NoError(t, err)
+
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	send := func(data alertmanager.Data) error {
+		close(sending)
+		<-release
+		return nil
+	}
+
+	d := NewDispatcher(q, send, 1, 0, time.Millisecond)
+	d.Start()
+	assert.NoError(t, d.Enqueue(alertmanager.Data{GroupKey: "a", Status: "firing"}))
+	<-sending
+
+	// The stop times out while the notification is being sent
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.False(t, d.Stop(ctx))
+
+	// The notification is still acknowledged once sent, it is not replayed on the next start
+	close(release)
+	select {
+	case <-d.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queue was not closed")
+	}
+	q, err = Open(directory)
+	assert.NoError(t, err)
+	assert.Empty(t, q.Pending())
+	assert.NoError(t, q.Close())
+}
@@ -0,0 +1,117 @@
+package routing
+
+import (
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/templates"
+	"github.com/prometheus/alertmanager/template"
+)
+
+const DefaultTimeoutMinutes = config.DefaultTimeoutMinutes
+
+// Route is a config.Route with its templates parsed and its empty fields inherited from the default route
+type Route struct {
+	Name             string
+	Matchers         config.Matchers
+	CustomDeviceName *templates.Template
+	Group            string
+	// EntitySelector is nil if the events should always go to the Custom Device
+	EntitySelector *templates.Template
+	// EventType is empty if the event type should be derived from the severity
+	EventType      string
+	TimeoutMinutes int
+	Tags           []Tag
+}
+
+// Router selects the Route of each alert
+type Router struct {
+	routes       []*Route
+	defaultRoute *Route
+}
+
+// New builds the Router from the configuration, which must have been validated by config.Load
+func New(cfg *config.Config) *Router {
+	defaultConfig := cfg.DefaultRoute
+	if defaultConfig.Name == "" {
+		defaultConfig.Name = "default"
+	}
+	if defaultConfig.CustomDeviceName == "" {
+		defaultConfig.CustomDeviceName = cfg.Templates.CustomDeviceName
+	}
+	if defaultConfig.Group == "" {
+		defaultConfig.Group = cfg.Dynatrace.GroupName
+	}
+	if defaultConfig.TimeoutMinutes == 0 {
+		defaultConfig.TimeoutMinutes = DefaultTimeoutMinutes
+	}
+	defaultRoute := newRoute(defaultConfig)
+
+	var routes []*Route
+	for _, routeConfig := range cfg.Routes {
+		route := newRoute(routeConfig)
+		if route.CustomDeviceName == nil {
+			route.CustomDeviceName = defaultRoute.CustomDeviceName
+		}
+		if route.Group == "" {
+			route.Group = defaultRoute.Group
+		}
+		if route.EntitySelector == nil {
+			route.EntitySelector = defaultRoute.EntitySelector
+		}
+		if route.EventType == "" {
+			route.EventType = defaultRoute.EventType
+		}
+		if route.TimeoutMinutes == 0 {
+			route.TimeoutMinutes = defaultRoute.TimeoutMinutes
+		}
+		if route.Tags == nil {
+			route.Tags = defaultRoute.Tags
+		}
+		routes = append(routes, route)
+	}
+
+	return &Router{
+		routes:       routes,
+		defaultRoute: defaultRoute,
+	}
+}
+
+func newRoute(routeConfig config.Route) *Route {
+	// The templates have already been validated by config.Load
+	customDeviceName, _ := templates.New(routeConfig.Name+".customDeviceName", routeConfig.CustomDeviceName)
+	entitySelector, _ := templates.New(routeConfig.Name+".entitySelector", routeConfig.EntitySelector)
+
+	// An empty list, unlike a missing one, is kept: the route doesn't inherit the tags of the default route
+	var tags []Tag
+	if routeConfig.Tags != nil {
+		tags = []Tag{}
+	}
+	for _, tagConfig := range routeConfig.Tags {
+		tags = append(tags, newTag(routeConfig.Name, tagConfig))
+	}
+
+	return &Route{
+		Name:             routeConfig.Name,
+		Matchers:         routeConfig.Matchers,
+		CustomDeviceName: customDeviceName,
+		Group:            routeConfig.Group,
+		EntitySelector:   entitySelector,
+		EventType:        routeConfig.EventType,
+		TimeoutMinutes:   routeConfig.TimeoutMinutes,
+		Tags:             tags,
+	}
+}
+
+// Match returns the first route matching the labels of the alert, or the default route
+func (r *Router) Match(alert template.Alert) *Route {
+	for _, route := range r.routes {
+		if route.Matchers.Matches(alert.Labels) {
+			return route
+		}
+	}
+	return r.defaultRoute
+}
+
+// Default returns the route used for alerts that don't match any other route
+func (r *Router) Default() *Route {
+	return r.defaultRoute
+}
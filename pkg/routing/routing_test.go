@@ -0,0 +1,186 @@
+package routing
+
+import (
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/templates"
+	dtapi "github.com/dlopes7/dynatrace-go-client/api"
+	"github.com/prometheus/alertmanager/template"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+const routesConfig = `
+routes:
+  - name: platform
+    matchers: ['namespace=~"openshift-.*"', 'severity!=info']
+    group: OpenShift Platform
+    eventType: AVAILABILITY_EVENT
+    tags:
+      - key: team
+        value: platform
+      - key: cluster
+        value: '{{ .Labels.cluster }}'
+  - name: applications
+    matchers: ['namespace!~kube-.*']
+    customDeviceName: 'App - {{ .Labels.namespace }}'
+    timeoutMinutes: 30
+defaultRoute:
+  customDeviceName: 'Alertmanager - {{ .Labels.alertname }}'
+`
+
+func newRouter(t *testing.T) *Router {
+	cfg := config.Default()
+	cfg.Dynatrace.GroupName = "Alertmanager"
+	if err := yaml.UnmarshalStrict([]byte(routesConfig), cfg); err != nil {
+		t.Fatal(err)
+	}
+	return New(cfg)
+}
+
+func TestMatch(t *testing.T) {
+	router := newRouter(t)
+
+	platform := router.Match(template.Alert{Labels: template.KV{"namespace": "openshift-monitoring", "severity": "critical"}})
+	assert.Equal(t, "platform", platform.Name)
+	assert.Equal(t, "OpenShift Platform", platform.Group)
+	assert.Equal(t, "AVAILABILITY_EVENT", platform.EventType)
+	assert.Equal(t, DefaultTimeoutMinutes, platform.TimeoutMinutes)
+
+	// The severity matcher excludes info alerts from the platform route
+	applications := router.Match(template.Alert{Labels: template.KV{"namespace": "openshift-monitoring", "severity": "info"}})
+	assert.Equal(t, "applications", applications.Name)
+	assert.Equal(t, "Alertmanager", applications.Group)
+	assert.Equal(t, "", applications.EventType)
+	assert.Equal(t, 30, applications.TimeoutMinutes)
+
+	fallback := router.Match(template.Alert{Labels: template.KV{"namespace": "kube-system", "alertname": "TargetDown"}})
+	assert.Equal(t, "default", fallback.Name)
+	assert.Equal(t, router.Default(), fallback)
+
+	ctx := templates.Context{Alert: template.Alert{Labels: template.KV{"namespace": "shop", "alertname": "TargetDown"}}}
+	assert.Equal(t, "App - shop", applications.CustomDeviceName.Render(ctx, "default"))
+	assert.Equal(t, "Alertmanager - TargetDown", platform.CustomDeviceName.Render(ctx, "default"))
+}
+
+func TestInheritTags(t *testing.T) {
+	cfg := config.Default()
+	if err := yaml.UnmarshalStrict([]byte(`
+routes:
+  - name: inherits
+    matchers: ['namespace="shop"']
+  - name: untagged
+    matchers: ['namespace="sandbox"']
+    tags: []
+defaultRoute:
+  tags:
+    - key: team
+      value: platform
+`), cfg); err != nil {
+		t.Fatal(err)
+	}
+	router := New(cfg)
+
+	inherits := router.Match(template.Alert{Labels: template.KV{"namespace": "shop"}})
+	assert.Equal(t, "inherits", inherits.Name)
+	assert.Len(t, inherits.Tags, 1)
+
+	untagged := router.Match(template.Alert{Labels: template.KV{"namespace": "sandbox"}})
+	assert.Equal(t, "untagged", untagged.Name)
+	assert.Empty(t, untagged.Tags)
+}
+
+func TestRenderTags(t *testing.T) {
+	router := newRouter(t)
+	alert := template.Alert{Labels: template.KV{"namespace": "openshift-monitoring", "cluster": "ocp4-intra-prod"}}
+	route := router.Match(alert)
+
+	assert.Equal(t, []dtapi.Tag{{Key: "team", Value: "platform"}, {Key: "cluster", Value: "ocp4-intra-prod"}}, route.RenderTags(templates.Context{Alert: alert}))
+
+	// Tags rendering to an empty value are skipped
+	alert.Labels["cluster"] = ""
+	assert.Equal(t, []dtapi.Tag{{Key: "team", Value: "platform"}}, route.RenderTags(templates.Context{Alert: alert}))
+}
+
+func TestParseMatcher(t *testing.T) {
+	valid := map[string]string{
+		`severity=critical`:          `severity="critical"`,
+		` severity != "warning" `:    `severity!="warning"`,
+		`namespace=~"openshift-.*"`:  `namespace=~"openshift-.*"`,
+		`alertname!~Watchdog|Info.*`: `alertname!~"Watchdog|Info.*"`,
+	}
+	for input, expected := range valid {
+		matcher, err := config.ParseMatcher(input)
+		if assert.NoError(t, err, input) {
+			assert.Equal(t, expected, matcher.String())
+		}
+	}
+
+	for _, input := range []string{`severity`, `1severity=critical`, `severity=~"("`, `severity="critical`} {
+		_, err := config.ParseMatcher(input)
+		assert.Error(t, err, input)
+	}
+}
+
+// legacyTagsConfig reproduces the tags that used to be hardcoded in the receiver, it is documented in the README
+const legacyTagsConfig = `
+defaultRoute:
+  tags:
+    - key: CodeAppli
+      label: label_code_app
+    - key: CodeAppli
+      value: i3
+      matchers: ['label_code_app=""', 'ocp_cluster!=""']
+    - key: Appname
+      label: namespace
+      matchers: ['label_code_app!=""']
+    - key: Appname
+      value: k8S
+      matchers: ['label_code_app=""', 'ocp_cluster!=""']
+    - key: Plateforme
+      label: label_env
+      matchers: ['label_code_app!=""']
+    - key: Plateforme
+      label: ocp_cluster
+      lookup:
+        ocp4-intra-prod: p
+        ocp4-intra-dev: r
+      matchers: ['label_code_app=""']
+    - key: Clustername
+      label: ocp_cluster
+`
+
+func TestRenderTagsMapping(t *testing.T) {
+	cfg := config.Default()
+	if err := yaml.UnmarshalStrict([]byte(legacyTagsConfig), cfg); err != nil {
+		t.Fatal(err)
+	}
+	route := New(cfg).Default()
+
+	render := func(labels template.KV) []dtapi.Tag {
+		return route.RenderTags(templates.Context{Alert: template.Alert{Labels: labels}})
+	}
+
+	assert.Equal(t, []dtapi.Tag{
+		{Key: "CodeAppli", Value: "app01"},
+		{Key: "Appname", Value: "shop"},
+		{Key: "Plateforme", Value: "prod"},
+		{Key: "Clustername", Value: "ocp4-intra-prod"},
+	}, render(template.KV{"label_code_app": "app01", "namespace": "shop", "label_env": "prod", "ocp_cluster": "ocp4-intra-prod"}))
+
+	assert.Equal(t, []dtapi.Tag{
+		{Key: "CodeAppli", Value: "i3"},
+		{Key: "Appname", Value: "k8S"},
+		{Key: "Plateforme", Value: "r"},
+		{Key: "Clustername", Value: "ocp4-intra-dev"},
+	}, render(template.KV{"namespace": "shop", "ocp_cluster": "ocp4-intra-dev"}))
+
+	// Clusters missing from the lookup table don't get a Plateforme, there is no default
+	assert.Equal(t, []dtapi.Tag{
+		{Key: "CodeAppli", Value: "i3"},
+		{Key: "Appname", Value: "k8S"},
+		{Key: "Clustername", Value: "ocp4-other"},
+	}, render(template.KV{"ocp_cluster": "ocp4-other"}))
+
+	assert.Nil(t, render(template.KV{"namespace": "shop"}))
+}
@@ -0,0 +1,80 @@
+package routing
+
+import (
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/templates"
+	dtapi "github.com/dlopes7/dynatrace-go-client/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Tag is a config.Tag with its value template parsed
+type Tag struct {
+	Key      string
+	Label    string
+	Value    *templates.Template
+	Lookup   map[string]string
+	Default  string
+	Matchers config.Matchers
+}
+
+func newTag(routeName string, tagConfig config.Tag) Tag {
+	// The templates have already been validated by config.Load
+	value, _ := templates.New(routeName+".tags."+tagConfig.Key, tagConfig.Value)
+	return Tag{
+		Key:      tagConfig.Key,
+		Label:    tagConfig.Label,
+		Value:    value,
+		Lookup:   tagConfig.Lookup,
+		Default:  tagConfig.Default,
+		Matchers: tagConfig.Matchers,
+	}
+}
+
+// Render returns the Dynatrace tag for the alert, and false if the tag should not be applied
+func (t *Tag) Render(ctx templates.Context) (dtapi.Tag, bool) {
+	if !t.Matchers.Matches(ctx.Labels) {
+		return dtapi.Tag{}, false
+	}
+
+	// A tag without a value source is a static tag, its value being the default, if any
+	if t.Label == "" && t.Value == nil {
+		return dtapi.Tag{Key: t.Key, Value: t.Default}, true
+	}
+
+	value := ctx.Labels[t.Label]
+	if t.Value != nil {
+		var err error
+		if value, err = t.Value.Execute(ctx); err != nil {
+			log.WithFields(log.Fields{"tag": t.Key, "error": err.Error()}).Warning("Routing - Could not render the tag value, using the default")
+			value = ""
+		}
+	}
+
+	if value != "" && t.Lookup != nil {
+		translated, ok := t.Lookup[value]
+		if !ok {
+			log.WithFields(log.Fields{"tag": t.Key, "value": value}).Debug("Routing - The value is not in the lookup table, using the default")
+		}
+		value = translated
+	}
+
+	if value == "" {
+		value = t.Default
+	}
+	if value == "" {
+		log.WithFields(log.Fields{"tag": t.Key}).Debug("Routing - The tag value is empty, skipping the tag")
+		return dtapi.Tag{}, false
+	}
+	return dtapi.Tag{Key: t.Key, Value: value}, true
+}
+
+// RenderTags renders the tags of the route for an alert, skipping the tags that don't apply to it
+func (r *Route) RenderTags(ctx templates.Context) []dtapi.Tag {
+	var tags []dtapi.Tag
+	for _, tag := range r.Tags {
+		if rendered, ok := tag.Render(ctx); ok {
+			tags = append(tags, rendered)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/cache"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// AdminProblem is a ProblemCache entry, with the key it is tracked under (the GroupKey hash or the alert fingerprint)
+type AdminProblem struct {
+	Key string `json:"key"`
+	cache.Problem
+}
+
+// adminRoutes registers the admin API, the tenant is selected with the tenant query parameter when there are several:
+//
+//	GET    /admin/problems                      lists the cached problems
+//	GET    /admin/problems/{key}                returns a cached problem
+//	DELETE /admin/problems/{key}                removes a problem from the cache, without closing it
+//	POST   /admin/problems/{key}/close          closes the Dynatrace problem and removes it from the cache
+//	POST   /admin/jobs/{UpdateProblemIDs|ResendEvents|Reconcile}  runs a scheduled job now
+//	GET    /admin/reconcile                     returns the report of the last reconciliation with Dynatrace
+//	POST   /admin/reconcile                     reconciles the ProblemCache with Dynatrace now, and returns the report
+//	GET    /admin/devices                       lists the cached Custom Devices
+//	POST   /admin/devices/resync                pushes the cached Custom Devices to Dynatrace again
+func (s *Server) adminRoutes(mux *http.ServeMux) {
+	mux.Handle("/admin/problems", s.adminAuth(http.HandlerFunc(s.adminProblems)))
+	mux.Handle("/admin/problems/", s.adminAuth(http.HandlerFunc(s.adminProblem)))
+	mux.Handle("/admin/jobs/", s.adminAuth(http.HandlerFunc(s.adminJobs)))
+	mux.Handle("/admin/reconcile", s.adminAuth(http.HandlerFunc(s.adminReconcile)))
+	mux.Handle("/admin/devices", s.adminAuth(http.HandlerFunc(s.adminDevices)))
+	mux.Handle("/admin/devices/resync", s.adminAuth(http.HandlerFunc(s.adminResyncDevices)))
+}
+
+// adminAuth rejects the requests without the admin token as bearer token
+func (s *Server) adminAuth(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + s.cfg.Admin.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			log.WithFields(log.Fields{"path": r.URL.Path, "remoteAddr": r.RemoteAddr}).Warning("Server - Rejected an unauthenticated admin request")
+			writeJSON(w, http.StatusUnauthorized, Response{Error: true, Message: "Missing or invalid admin token"})
+			return
+		}
+		log.WithFields(log.Fields{"method": r.Method, "path": r.URL.Path, "remoteAddr": r.RemoteAddr}).Info("Server - Admin request")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminTenant returns the tenant selected by the tenant query parameter, it is optional if there is a single tenant
+func (s *Server) adminTenant(w http.ResponseWriter, r *http.Request) (*tenant, bool) {
+	name := r.URL.Query().Get("tenant")
+	if name == "" && len(s.tenants) == 1 {
+		return s.tenants[0], true
+	}
+	if t, ok := s.tenantsByName[name]; ok {
+		return t, true
+	}
+	if name == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Error: true, Message: fmt.Sprintf("The tenant query parameter is mandatory, must be one of %s", strings.Join(s.cfg.TenantNames(), ", "))})
+	} else {
+		writeJSON(w, http.StatusNotFound, Response{Error: true, Message: fmt.Sprintf("Unknown tenant %s", name)})
+	}
+	return nil, false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusMethodNotAllowed, Response{Error: true, Message: fmt.Sprintf("%s is not allowed on %s", r.Method, r.URL.Path)})
+}
+
+func (s *Server) adminProblems(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	t, ok := s.adminTenant(w, r)
+	if !ok {
+		return
+	}
+
+	problems := []AdminProblem{}
+	for key, problem := range t.problemCache.GetCache().Problems {
+		problems = append(problems, AdminProblem{Key: key, Problem: problem})
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].CreatedAt.Before(problems[j].CreatedAt) })
+	writeJSON(w, http.StatusOK, problems)
+}
+
+func (s *Server) adminProblem(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/problems/"), "/")
+	key := parts[0]
+	if key == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != "close") {
+		writeJSON(w, http.StatusNotFound, Response{Error: true, Message: fmt.Sprintf("Unknown path %s", r.URL.Path)})
+		return
+	}
+
+	t, ok := s.adminTenant(w, r)
+	if !ok {
+		return
+	}
+
+	problem, ok := t.problemCache.GetCache().Problems[key]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, Response{Error: true, Message: fmt.Sprintf("Could not find the problem %s in the ProblemCache", key)})
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		if err := t.dt.CloseProblem(key); err != nil {
+			writeJSON(w, http.StatusBadGateway, Response{Error: true, Message: fmt.Sprintf("Could not close the problem: %s", err.Error())})
+			return
+		}
+		writeJSON(w, http.StatusOK, Response{Message: fmt.Sprintf("Closed the problem %s", key)})
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, AdminProblem{Key: key, Problem: problem})
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		t.problemCache.Lock()
+		t.problemCache.Delete(key)
+		t.problemCache.UnLock()
+		writeJSON(w, http.StatusOK, Response{Message: fmt.Sprintf("Deleted the problem %s from the ProblemCache", key)})
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+func (s *Server) adminJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	t, ok := s.adminTenant(w, r)
+	if !ok {
+		return
+	}
+
+	jobs := map[string]func(){
+		"UpdateProblemIDs": t.scheduler.UpdateProblemIDs,
+		"ResendEvents":     t.scheduler.ResendEvents,
+		"Reconcile":        t.scheduler.Reconcile,
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/admin/jobs/")
+	job, ok := jobs[name]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, Response{Error: true, Message: fmt.Sprintf("Unknown job %s, must be UpdateProblemIDs, ResendEvents or Reconcile", name)})
+		return
+	}
+
+	// The jobs log their own errors, and never return them
+	job()
+	writeJSON(w, http.StatusOK, Response{Message: fmt.Sprintf("Ran %s", name)})
+}
+
+func (s *Server) adminReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	t, ok := s.adminTenant(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		t.scheduler.Reconcile()
+	}
+	report := t.scheduler.LastReconcile()
+	if report == nil {
+		writeJSON(w, http.StatusNotFound, Response{Error: true, Message: "The ProblemCache has not been reconciled yet"})
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Server) adminDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	if t, ok := s.adminTenant(w, r); ok {
+		writeJSON(w, http.StatusOK, t.dt.CustomDevices())
+	}
+}
+
+func (s *Server) adminResyncDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+	if t, ok := s.adminTenant(w, r); ok {
+		writeJSON(w, http.StatusOK, t.dt.ResyncCustomDevices())
+	}
+}
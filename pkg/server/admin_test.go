@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dtclient/fake"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/jobs"
+	"github.com/prometheus/alertmanager/template"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAPI(t *testing.T) {
+	dt := fake.New("my-token")
+	defer dt.Close()
+
+	cfg := config.Default()
+	cfg.Dynatrace.APIURL = dt.URL
+	cfg.Dynatrace.APIToken = "my-token"
+	cfg.Dynatrace.ProblemSeverities = []string{"critical"}
+	cfg.Dynatrace.Retries = 0
+	cfg.Cache.Backend = config.CacheBackendMemory
+	cfg.Admin = config.Admin{Enabled: true, Token: "admin-token"}
+	assert.NoError(t, cfg.Validate())
+
+	s, err := New(cfg)
+	assert.NoError(t, err)
+	mux := http.NewServeMux()
+	s.adminRoutes(mux)
+
+	call := func(method string, path string, token string, result interface{}) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, req)
+		if result != nil {
+			assert.NoError(t, json.NewDecoder(recorder.Body).Decode(result))
+		}
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/admin/problems", "wrong-token", nil))
+
+	alert := template.Alert{Status: "firing", Labels: template.KV{"alertname": "Test", "severity": "critical"}}
+	for _, groupKey := range []string{"first", "second"} {
+		assert.NoError(t, s.SendAlerts(alertmanager.Data{Status: "firing", GroupKey: groupKey, Alerts: template.Alerts{alert}}, ""))
+	}
+
+	var problems []AdminProblem
+	assert.Equal(t, http.StatusOK, call(http.MethodGet, "/admin/problems", "admin-token", &problems))
+	if assert.Len(t, problems, 2) {
+		assert.Equal(t, "first", problems[0].Alert.GroupKey)
+		assert.Empty(t, problems[0].ProblemID)
+	}
+
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, "/admin/jobs/UpdateProblemIDs", "admin-token", nil))
+	var problem AdminProblem
+	assert.Equal(t, http.StatusOK, call(http.MethodGet, "/admin/problems/"+problems[0].Key, "admin-token", &problem))
+	assert.NotEmpty(t, problem.ProblemID)
+
+	assert.Equal(t, http.StatusNotFound, call(http.MethodGet, "/admin/reconcile", "admin-token", nil))
+	var report jobs.ReconcileReport
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, "/admin/reconcile", "admin-token", &report))
+	assert.Equal(t, 2, report.Checked)
+	assert.Empty(t, report.Dropped)
+	assert.Equal(t, http.StatusOK, call(http.MethodGet, "/admin/reconcile", "admin-token", nil))
+
+	// Both events are on the same Custom Device, Dynatrace merged them in a single problem
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, "/admin/problems/"+problems[0].Key+"/close", "admin-token", nil))
+	assert.Empty(t, dt.OpenProblems())
+	assert.Equal(t, http.StatusNotFound, call(http.MethodGet, "/admin/problems/"+problems[0].Key, "admin-token", nil))
+
+	assert.Equal(t, http.StatusOK, call(http.MethodDelete, "/admin/problems/"+problems[1].Key, "admin-token", nil))
+	assert.Equal(t, http.StatusOK, call(http.MethodGet, "/admin/problems", "admin-token", &problems))
+	assert.Empty(t, problems)
+
+	assert.Equal(t, http.StatusNotFound, call(http.MethodPost, "/admin/jobs/DeleteEverything", "admin-token", nil))
+
+	var devices []map[string]interface{}
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, "/admin/devices/resync", "admin-token", &devices))
+	if assert.Len(t, devices, 1) {
+		assert.Equal(t, "Alertmanager Events", devices[0]["name"])
+		assert.Nil(t, devices[0]["error"])
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reasons of the webhook_auth_failures_total metric
+const (
+	authFailureClientCertificate = "client_certificate"
+	authFailureMissing           = "missing_credentials"
+	authFailureInvalid           = "invalid_credentials"
+)
+
+// webhookAuth rejects the requests without the configured client certificate, bearer token or basic auth credentials
+func (s *Server) webhookAuth(next http.Handler) http.Handler {
+	auth := s.cfg.Webhook.Auth
+	requireClientCertificate := s.cfg.Webhook.TLS.ClientCAFile != ""
+	if !requireClientCertificate && auth.BearerToken == "" && auth.BasicAuth.Username == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason := ""
+		// The client certificate is verified during the handshake, if one was sent
+		if requireClientCertificate && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			reason = authFailureClientCertificate
+		} else if auth.BearerToken != "" {
+			header := r.Header.Get("Authorization")
+			if header == "" {
+				reason = authFailureMissing
+			} else if subtle.ConstantTimeCompare([]byte(header), []byte("Bearer "+auth.BearerToken)) != 1 {
+				reason = authFailureInvalid
+			}
+		} else if auth.BasicAuth.Username != "" {
+			username, password, ok := r.BasicAuth()
+			if !ok {
+				reason = authFailureMissing
+			} else if subtle.ConstantTimeCompare([]byte(username), []byte(auth.BasicAuth.Username)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(password), []byte(auth.BasicAuth.Password)) != 1 {
+				reason = authFailureInvalid
+			}
+		}
+
+		if reason != "" {
+			metrics.AuthFailures.WithLabelValues(reason).Inc()
+			log.WithFields(log.Fields{"reason": reason, "remoteAddr": r.RemoteAddr}).Warning("Server - Rejected an unauthenticated webhook request")
+			if auth.BasicAuth.Username != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="dynatrace-receiver"`)
+			}
+			writeJSON(w, http.StatusUnauthorized, Response{Error: true, Message: "Missing or invalid credentials"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tlsConfig returns the TLS configuration of the server, the certificate is reloaded when its files change
+// Client certificates are optional during the handshake, so that /healthz and /metrics work without them, webhookAuth requires them for /webhook
+func tlsConfig(cfg config.TLS) (*tls.Config, error) {
+	certificate, err := newCertificateReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certificate.GetCertificate,
+	}
+	if cfg.ClientCAFile != "" {
+		tlsConfig.ClientCAs, err = config.LoadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// certificateReloader serves a certificate and reloads it when the modification time of its files changes
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	lock        sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	c := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// latestModTime returns the most recent modification time of the certificate and the key
+func (c *certificateReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, location := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(location)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certificateReloader) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.certificate = &certificate
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate is called for every handshake, the previous certificate is kept if the new files can't be loaded (ie: only one was written yet)
+func (c *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	modTime, err := c.latestModTime()
+	if err == nil && !modTime.Equal(c.modTime) {
+		if err = c.reload(); err == nil {
+			log.WithFields(log.Fields{"certFile": c.certFile}).Info("Server - Reloaded the TLS certificate")
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"certFile": c.certFile, "error": err.Error()}).Warning("Server - Could not reload the TLS certificate, using the previous one")
+	}
+	return c.certificate, nil
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newCertificate creates a certificate signed by parent, or a self-signed CA if parent is nil
+func newCertificate(t *testing.T, commonName string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, _ := x509.ParseCertificate(der)
+	return &testCertificate{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// write writes the certificate and its key in directory, it returns their locations
+func (c *testCertificate) write(t *testing.T, directory string) (string, string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	assert.NoError(t, err)
+	certFile, keyFile := filepath.Join(directory, "tls.crt"), filepath.Join(directory, "tls.key")
+	assert.NoError(t, ioutil.WriteFile(certFile, c.pem, 0644))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+var accepted = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func TestWebhookAuth(t *testing.T) {
+	cases := []struct {
+		auth    config.WebhookAuth
+		request func(r *http.Request)
+		status  int
+		reason  string
+	}{
+		{config.WebhookAuth{}, func(r *http.Request) {}, http.StatusOK, ""},
+		{config.WebhookAuth{BearerToken: "secret"}, func(r *http.Request) {}, http.StatusUnauthorized, authFailureMissing},
+		{config.WebhookAuth{BearerToken: "secret"}, func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized, authFailureInvalid},
+		{config.WebhookAuth{BearerToken: "secret"}, func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, http.StatusOK, ""},
+		{config.WebhookAuth{BasicAuth: config.BasicAuth{Username: "alertmanager", Password: "secret"}}, func(r *http.Request) {}, http.StatusUnauthorized, authFailureMissing},
+		{config.WebhookAuth{BasicAuth: config.BasicAuth{Username: "alertmanager", Password: "secret"}}, func(r *http.Request) { r.SetBasicAuth("alertmanager", "wrong") }, http.StatusUnauthorized, authFailureInvalid},
+		{config.WebhookAuth{BasicAuth: config.BasicAuth{Username: "alertmanager", Password: "secret"}}, func(r *http.Request) { r.SetBasicAuth("alertmanager", "secret") }, http.StatusOK, ""},
+	}
+
+	for i, c := range cases {
+		cfg := config.Default()
+		cfg.Webhook.Auth = c.auth
+		s := &Server{cfg: cfg}
+
+		failures := testutil.ToFloat64(metrics.AuthFailures.WithLabelValues(c.reason))
+		req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+		c.request(req)
+		recorder := httptest.NewRecorder()
+		s.webhookAuth(accepted).ServeHTTP(recorder, req)
+
+		assert.Equal(t, c.status, recorder.Code, "case %d", i)
+		if c.reason != "" {
+			assert.Equal(t, failures+1, testutil.ToFloat64(metrics.AuthFailures.WithLabelValues(c.reason)), "case %d", i)
+		}
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newCertificate(t, "ca", nil)
+	directory := t.TempDir()
+	certFile, keyFile := newCertificate(t, "receiver", ca).write(t, directory)
+	caFile := filepath.Join(directory, "ca.crt")
+	assert.NoError(t, ioutil.WriteFile(caFile, ca.pem, 0644))
+
+	cfg := config.Default()
+	cfg.Webhook.TLS = config.TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile}
+	s := &Server{cfg: cfg}
+
+	// httptest.Server.StartTLS would replace our certificate with its own
+	serverTLS, err := tlsConfig(cfg.Webhook.TLS)
+	assert.NoError(t, err)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	assert.NoError(t, err)
+	server := &http.Server{Handler: s.webhookAuth(accepted), ErrorLog: log.New(ioutil.Discard, "", 0)}
+	go server.Serve(listener)
+	defer server.Close()
+	url := "https://" + listener.Addr().String() + "/webhook"
+
+	post := func(clientCertificates ...tls.Certificate) int {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: clientCertificates}}}
+		resp, err := client.Post(url, "application/json", nil)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, post())
+	assert.Equal(t, http.StatusOK, post(newCertificate(t, "alertmanager", ca).tlsCertificate()))
+
+	// Go clients don't send certificates from CAs the server didn't ask for, the request is then unauthenticated
+	other := newCertificate(t, "other", nil)
+	assert.Equal(t, http.StatusUnauthorized, post(newCertificate(t, "alertmanager", other).tlsCertificate()))
+}
+
+func TestCertificateReload(t *testing.T) {
+	directory := t.TempDir()
+	first := newCertificate(t, "first", nil)
+	certFile, keyFile := first.write(t, directory)
+
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	assert.NoError(t, err)
+	served, _ := reloader.GetCertificate(nil)
+	assert.Equal(t, first.cert.Raw, served.Certificate[0])
+
+	second := newCertificate(t, "second", nil)
+	second.write(t, directory)
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+	served, _ = reloader.GetCertificate(nil)
+	assert.Equal(t, second.cert.Raw, served.Certificate[0])
+
+	// A certificate that doesn't match the key is ignored
+	assert.NoError(t, ioutil.WriteFile(certFile, first.pem, 0644))
+	later = later.Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+	served, _ = reloader.GetCertificate(nil)
+	assert.Equal(t, second.cert.Raw, served.Certificate[0])
+}
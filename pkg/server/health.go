@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	CheckStatusOK      = "ok"
+	CheckStatusFailing = "failing"
+)
+
+// cronGracePeriod is how late a scheduled job can be before the scheduler is considered stuck
+const cronGracePeriod = time.Minute
+
+// CheckResult is the outcome of a single check of /healthz or /readyz
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthResponse is the body of /healthz and /readyz, Status is failing if any of the checks failed
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// healthz is the liveness check, the process is serving requests and the scheduled jobs are running
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, "healthz", map[string]error{
+		"cron": s.checkCron(),
+	})
+}
+
+// readyz is the readiness check, the receiver can send events to Dynatrace and persist its caches
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]error{}
+	single := len(s.tenants) == 1
+	for _, t := range s.tenants {
+		checks[t.checkName("dynatrace", single)] = t.apiV2.Ping()
+		if t.cfg.Cache.Backend != config.CacheBackendMemory {
+			checks[t.checkName("cache", single)] = checkWritable(t.cfg.Cache.Directory)
+		}
+		if t.cfg.Queue.Enabled {
+			checks[t.checkName("queue", single)] = checkWritable(t.cfg.Queue.Directory)
+		}
+	}
+	writeHealth(w, "readyz", checks)
+}
+
+func writeHealth(w http.ResponseWriter, name string, checks map[string]error) {
+	resp := HealthResponse{Status: CheckStatusOK, Checks: map[string]CheckResult{}}
+	for check, err := range checks {
+		if err != nil {
+			resp.Status = CheckStatusFailing
+			resp.Checks[check] = CheckResult{Status: CheckStatusFailing, Error: err.Error()}
+			log.WithFields(log.Fields{"check": check, "error": err.Error()}).Warningf("Server - The %s check failed", name)
+			continue
+		}
+		resp.Checks[check] = CheckResult{Status: CheckStatusOK}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != CheckStatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// checkCron returns an error if the scheduler was not started, or if a job is late, which means the scheduler is stuck
+func (s *Server) checkCron() error {
+	if s.cron == nil {
+		return fmt.Errorf("the scheduler is not running")
+	}
+	for _, entry := range s.cron.Entries() {
+		if entry.Next.IsZero() {
+			return fmt.Errorf("the scheduler is not running")
+		}
+		if late := time.Since(entry.Next); late > cronGracePeriod {
+			return fmt.Errorf("job %d is late by %s, the scheduler is stuck", entry.ID, late.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// checkWritable creates and removes a file in the directory
+func checkWritable(directory string) error {
+	file, err := ioutil.TempFile(directory, ".readyz-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %s", directory, err.Error())
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/apiv2"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dtclient/fake"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+func checkHealth(t *testing.T, handler http.HandlerFunc) (int, HealthResponse) {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	var resp HealthResponse
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&resp))
+	return recorder.Code, resp
+}
+
+func TestReadyz(t *testing.T) {
+	dt := fake.New("my-token")
+	defer dt.Close()
+
+	cfg := config.Default()
+	cfg.Dynatrace.APIURL = dt.URL
+	cfg.Dynatrace.APIToken = "my-token"
+	cfg.Cache.Directory = t.TempDir()
+	s := &Server{cfg: cfg, tenants: []*tenant{{name: config.DefaultTenantName, cfg: cfg, apiV2: apiv2.New(cfg)}}}
+
+	code, resp := checkHealth(t, s.readyz)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HealthResponse{Status: CheckStatusOK, Checks: map[string]CheckResult{
+		"dynatrace": {Status: CheckStatusOK},
+		"cache":     {Status: CheckStatusOK},
+	}}, resp)
+
+	// A token without the entities.read scope is accepted
+	dt.Fail(http.MethodGet, "/api/v2/entities", http.StatusForbidden, 1)
+	code, resp = checkHealth(t, s.readyz)
+	assert.Equal(t, http.StatusOK, code)
+
+	cfg.Dynatrace.APIToken = "expired-token"
+	cfg.Cache.Directory = path.Join(cfg.Cache.Directory, "missing")
+	s = &Server{cfg: cfg, tenants: []*tenant{{name: config.DefaultTenantName, cfg: cfg, apiV2: apiv2.New(cfg)}}}
+
+	code, resp = checkHealth(t, s.readyz)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, CheckStatusFailing, resp.Status)
+	assert.Equal(t, CheckStatusFailing, resp.Checks["dynatrace"].Status)
+	assert.Contains(t, resp.Checks["dynatrace"].Error, "401")
+	assert.Equal(t, CheckStatusFailing, resp.Checks["cache"].Status)
+}
+
+func TestHealthz(t *testing.T) {
+	s := &Server{cfg: config.Default()}
+
+	code, resp := checkHealth(t, s.healthz)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "the scheduler is not running", resp.Checks["cron"].Error)
+
+	s.startJobs()
+	defer s.cron.Stop()
+	code, resp = checkHealth(t, s.healthz)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, CheckStatusOK, resp.Status)
+}
+
+func TestHealthzWithTenant(t *testing.T) {
+	dt := fake.New("my-token")
+	defer dt.Close()
+
+	cfg := config.Default()
+	cfg.Dynatrace.APIURL = dt.URL
+	cfg.Dynatrace.APIToken = "my-token"
+	cfg.Cache.Directory = t.TempDir()
+	assert.NoError(t, cfg.Validate())
+
+	s, err := New(cfg)
+	assert.NoError(t, err)
+	defer s.Close()
+	s.startJobs()
+	defer s.cron.Stop()
+
+	// The startup Reconcile has run, the scheduler is still healthy
+	s.startup.Wait()
+	assert.NotNil(t, s.tenants[0].scheduler.LastReconcile())
+	code, resp := checkHealth(t, s.healthz)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, CheckStatusOK, resp.Status)
+}
@@ -1,16 +1,22 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
 	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/cache"
-	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dynatrace"
-	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/jobs"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/robfig/cron/v3"
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 )
 
 type Response struct {
@@ -19,21 +25,31 @@ type Response struct {
 }
 
 type Server struct {
-	dt        dynatrace.Controller
-	scheduler jobs.Scheduler
+	cfg *config.Config
+	// tenants has a single tenant, config.DefaultTenantName, if there are no tenants in the configuration
+	tenants       []*tenant
+	tenantsByName map[string]*tenant
+	// cron runs the scheduled jobs of every tenant, it is nil until startJobs is called
+	cron *cron.Cron
+	// startup tracks the jobs run once by startJobs, outside of the cron
+	startup *sync.WaitGroup
 }
 
-func New() Server {
-	customDeviceCache := cache.NewCustomDeviceCacheService()
-	problemCache := cache.NewProblemCacheService()
-	scheduler := jobs.NewScheduler(&customDeviceCache, &problemCache)
-
-	log.WithFields(log.Fields{"DT_API_URL": os.Getenv("DT_API_URL")}).Info("Will use API URL")
-
-	return Server{
-		dt:        dynatrace.NewDynatraceController(&customDeviceCache, &problemCache, &scheduler),
-		scheduler: scheduler,
+func New(cfg *config.Config) (Server, error) {
+	s := Server{
+		cfg:           cfg,
+		tenantsByName: map[string]*tenant{},
+	}
+	for _, name := range cfg.TenantNames() {
+		t, err := newTenant(name, cfg.ForTenant(name))
+		if err != nil {
+			_ = s.Close()
+			return Server{}, fmt.Errorf("tenant %s: %s", name, err.Error())
+		}
+		s.tenants = append(s.tenants, t)
+		s.tenantsByName[name] = t
 	}
+	return s, nil
 }
 
 func (s *Server) webhook(w http.ResponseWriter, r *http.Request) {
@@ -54,9 +70,37 @@ func (s *Server) webhook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.WithFields(log.Fields{"data": fmt.Sprintf("%+v", data)}).Info("Server - Received data")
+	metrics.NotificationsReceived.WithLabelValues(data.Status).Inc()
+
+	t, err := s.tenantFor(data, strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhook"), "/"))
+	if err != nil {
+		// Alertmanager doesn't retry client errors, the notification can only be routed after a configuration change
+		w.WriteHeader(http.StatusNotFound)
+		resp = Response{
+			Error:   true,
+			Message: fmt.Sprintf("Could not route the notification: %s", err.Error()),
+		}
+		log.WithFields(log.Fields{"response": resp, "error": err.Error()}).Error("Server - Could not route the notification to a tenant")
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	if t.dispatcher != nil {
+		// The notification is on disk, it will be sent to Dynatrace in the background
+		if err := t.dispatcher.Enqueue(data); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			resp = Response{
+				Error:   true,
+				Message: fmt.Sprintf("Could not queue the alert: %s", err.Error()),
+			}
+			log.WithFields(log.Fields{"response": resp, "error": err.Error()}).Error("Server - Could not queue the alert")
+			_ = json.NewEncoder(w).Encode(resp)
+		}
+		return
+	}
 
 	// Attempt to send the alerts to Dynatrace
-	err := s.dt.SendAlerts(data)
+	err = t.dt.SendAlerts(data)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		resp = Response{
@@ -70,21 +114,248 @@ func (s *Server) webhook(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func Run() {
-	s := New()
-	c := cron.New()
-	c.AddFunc("@every 2m", s.scheduler.UpdateProblemIDs)
-	c.AddFunc("@every 30m", s.scheduler.ResendEvents)
-	c.AddFunc("@every 1h", s.scheduler.DeleteOldEvents)
+// SendAlerts sends a notification to the Dynatrace environment of its tenant right away, bypassing the queue
+// tenantName forces the tenant, like the /webhook/{tenant} path
+func (s *Server) SendAlerts(data alertmanager.Data, tenantName string) error {
+	t, err := s.tenantFor(data, tenantName)
+	if err != nil {
+		return err
+	}
+	return t.dt.SendAlerts(data)
+}
+
+// SendAlertsOnce sends a notification to the Dynatrace environment of its tenant without a Server, ie: for the command line
+// Only the caches and the Controller of the tenant are opened: the queue belongs to the webhook, which may be running,
+// opening it would compact the log it is writing to
+// It waits until ctx is done for the tags being applied
+func SendAlertsOnce(ctx context.Context, cfg *config.Config, data alertmanager.Data, pathTenant string) error {
+	name, err := tenantName(cfg, data, pathTenant)
+	if err != nil {
+		return err
+	}
+	t, err := openTenant(name, cfg.ForTenant(name))
+	if err != nil {
+		return fmt.Errorf("tenant %s: %s", name, err.Error())
+	}
+
+	sendErr := t.dt.SendAlerts(data)
+	if !t.dt.FlushTags(ctx) {
+		log.WithFields(log.Fields{"tenant": name}).Warning("Server - Could not apply the tags in time")
+	}
+	if err := t.storage.Close(); err != nil {
+		log.WithFields(log.Fields{"tenant": name, "error": err.Error()}).Warning("Server - Could not close the cache")
+	}
+	return sendErr
+}
+
+// Close releases the cache storages, the Server must not be used afterwards
+func (s *Server) Close() error {
+	var errs []string
+	for _, t := range s.tenants {
+		if err := t.storage.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("tenant %s: %s", t.name, err.Error()))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// registerCacheGauges exposes the size of the caches of all the tenants as metrics, it must only be called once
+func (s *Server) registerCacheGauges() {
+	metrics.RegisterCacheGauges(
+		func() int {
+			count := 0
+			for _, t := range s.tenants {
+				count += len(t.problemCache.GetCache().Problems)
+			}
+			return count
+		},
+		func() int {
+			count := 0
+			for _, t := range s.tenants {
+				for _, problem := range t.problemCache.GetCache().Problems {
+					if problem.ProblemID == "" {
+						count++
+					}
+				}
+			}
+			return count
+		},
+		func() int {
+			count := 0
+			for _, t := range s.tenants {
+				count += cache.CountCustomDevices(t.storage)
+			}
+			return count
+		},
+	)
+}
+
+func (s *Server) startJobs() {
+	// A job that is still running, ie: UpdateProblemIDs holding the problem cache lock on a slow API, is skipped rather than run twice
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cronLogger{})))
+	for _, t := range s.tenants {
+		// The schedules have already been validated by config.Load
+		c.AddFunc(t.cfg.Jobs.UpdateProblemIDs, t.scheduler.UpdateProblemIDs)
+		c.AddFunc(t.cfg.Jobs.ResendEvents, t.scheduler.ResendEvents)
+		c.AddFunc(t.cfg.Jobs.DeleteOldEvents, t.scheduler.DeleteOldEvents)
+		// Reconcile should run more often than ResendEvents, so that the problems closed by hand are not reopened
+		c.AddFunc(t.cfg.Jobs.Reconcile, t.scheduler.Reconcile)
+	}
 	c.Start()
+	s.cron = c
 
-	http.HandleFunc("/webhook", s.webhook)
+	// The first Reconcile runs at startup, it is not a cron entry: a job that never runs again has no next run,
+	// which checkCron would report as a stopped scheduler
+	s.startup = &sync.WaitGroup{}
+	for _, t := range s.tenants {
+		s.startup.Add(1)
+		go func(t *tenant) {
+			defer s.startup.Done()
+			t.scheduler.Reconcile()
+		}(t)
+	}
+}
 
-	listenAddress := ":9393"
-	if os.Getenv("WEBHOOK_PORT") != "" {
-		listenAddress = ":" + os.Getenv("WEBHOOK_PORT")
+// cronLogger sends the logs of the cron, ie: the skipped jobs, to logrus
+type cronLogger struct{}
+
+func (cronLogger) Info(msg string, keysAndValues ...interface{}) {
+	log.WithFields(cronFields(keysAndValues)).Info("Scheduler - ", msg)
+}
+
+func (cronLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	log.WithFields(cronFields(keysAndValues)).WithField("error", err.Error()).Error("Scheduler - ", msg)
+}
+
+func cronFields(keysAndValues []interface{}) log.Fields {
+	fields := log.Fields{}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields[fmt.Sprint(keysAndValues[i])] = keysAndValues[i+1]
+	}
+	return fields
+}
+
+// Shutdown stops the server gracefully, each step waits until ctx is done:
+// it stops accepting requests and waits for the in-flight ones, stops the queue workers and the scheduled jobs,
+// waits for the tags being applied and closes the caches
+// httpServer is nil if the Server was not serving requests, ie: for the command line
+func (s *Server) Shutdown(ctx context.Context, httpServer *http.Server) error {
+	var pending []string
+
+	// The synchronous SendAlerts calls are in-flight requests
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			pending = append(pending, fmt.Sprintf("in-flight requests (%s)", err.Error()))
+		}
+	}
+
+	for _, t := range s.tenants {
+		if t.dispatcher != nil && !t.dispatcher.Stop(ctx) {
+			pending = append(pending, fmt.Sprintf("queued notifications of %s", t.name))
+		}
+	}
+
+	if s.cron != nil {
+		select {
+		case <-s.cron.Stop().Done():
+		case <-ctx.Done():
+			pending = append(pending, "scheduled jobs")
+		}
+	}
+	if s.startup != nil {
+		startupDone := make(chan struct{})
+		go func() {
+			s.startup.Wait()
+			close(startupDone)
+		}()
+		select {
+		case <-startupDone:
+		case <-ctx.Done():
+			pending = append(pending, "startup jobs")
+		}
+	}
+
+	for _, t := range s.tenants {
+		if !t.dt.FlushTags(ctx) {
+			pending = append(pending, fmt.Sprintf("tags of %s", t.name))
+		}
+	}
+
+	// Nothing writes to the caches anymore, unless something above timed out
+	if err := s.Close(); err != nil {
+		pending = append(pending, fmt.Sprintf("caches (%s)", err.Error()))
+	}
+
+	if len(pending) > 0 {
+		return fmt.Errorf("could not finish in time: %s", strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+// Run serves the webhook until SIGINT or SIGTERM, it returns an error if the server could not start or stop gracefully
+func Run(cfg *config.Config) error {
+	s, err := New(cfg)
+	if err != nil {
+		return fmt.Errorf("could not start the server: %s", err.Error())
+	}
+	for _, t := range s.tenants {
+		if t.dispatcher != nil {
+			t.dispatcher.Start()
+		}
+	}
+
+	s.registerCacheGauges()
+	s.startJobs()
+
+	http.Handle("/webhook", s.webhookAuth(http.HandlerFunc(s.webhook)))
+	http.Handle("/webhook/", s.webhookAuth(http.HandlerFunc(s.webhook)))
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", s.healthz)
+	http.HandleFunc("/readyz", s.readyz)
+	if cfg.Admin.Enabled {
+		s.adminRoutes(http.DefaultServeMux)
+		log.Info("Server - Enabled the admin API")
+	}
+
+	listenAddress := fmt.Sprintf(":%d", cfg.Webhook.Port)
+	httpServer := &http.Server{Addr: listenAddress}
+	if cfg.Webhook.TLS.Enabled() {
+		httpServer.TLSConfig, err = tlsConfig(cfg.Webhook.TLS)
+		if err != nil {
+			_ = s.Close()
+			return fmt.Errorf("could not load the TLS configuration: %s", err.Error())
+		}
 	}
 
-	log.WithFields(log.Fields{"listenAddress": listenAddress}).Info("Server - Starting webhook")
-	log.Fatal(http.ListenAndServe(listenAddress, nil))
+	serveErrors := make(chan error, 1)
+	go func() {
+		log.WithFields(log.Fields{"listenAddress": listenAddress, "tls": cfg.Webhook.TLS.Enabled(), "clientCertificates": cfg.Webhook.TLS.ClientCAFile != ""}).Info("Server - Starting webhook")
+		if cfg.Webhook.TLS.Enabled() {
+			// The certificate comes from TLSConfig.GetCertificate
+			serveErrors <- httpServer.ListenAndServeTLS("", "")
+		} else {
+			serveErrors <- httpServer.ListenAndServe()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErrors:
+		_ = s.Close()
+		return fmt.Errorf("could not start the webhook: %s", err.Error())
+	case sig := <-signals:
+		log.WithFields(log.Fields{"signal": sig.String(), "timeout": cfg.Webhook.ShutdownTimeout}).Info("Server - Shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Webhook.ShutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx, httpServer); err != nil {
+		return err
+	}
+	log.Info("Server - Shut down gracefully")
+	return nil
 }
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dtclient/fake"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/utils"
+	"github.com/prometheus/alertmanager/template"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	dt := fake.New("my-token")
+	defer dt.Close()
+	dt.Latency = 50 * time.Millisecond
+
+	cfg := config.Default()
+	cfg.Dynatrace.APIURL = dt.URL
+	cfg.Dynatrace.APIToken = "my-token"
+	cfg.Dynatrace.ProblemSeverities = []string{"critical"}
+	cfg.Dynatrace.Retries = 0
+	cfg.Cache.Directory = t.TempDir()
+	cfg.Cache.Backend = config.CacheBackendBolt
+	cfg.DefaultRoute.Tags = []config.Tag{{Key: "team", Default: "platform"}}
+	assert.NoError(t, cfg.Validate())
+
+	s, err := New(cfg)
+	assert.NoError(t, err)
+	s.startJobs()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	httpServer := &http.Server{Handler: http.HandlerFunc(s.webhook)}
+	go httpServer.Serve(listener)
+
+	body, _ := json.Marshal(alertmanager.Data{
+		Status:   "firing",
+		GroupKey: "test",
+		Alerts:   template.Alerts{{Status: "firing", Labels: template.KV{"alertname": "Test", "severity": "critical"}}},
+	})
+	responses := make(chan int, 1)
+	go func() {
+		resp, err := http.Post("http://"+listener.Addr().String(), "application/json", bytes.NewReader(body))
+		if err != nil {
+			responses <- 0
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+
+	// Shut down while the notification is being sent
+	time.Sleep(25 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx, httpServer))
+
+	assert.Equal(t, http.StatusOK, <-responses)
+	assert.Len(t, dt.Events(), 1)
+	_, customDeviceID := utils.GenerateGroupAndCustomDeviceID("", "Alertmanager Events")
+	if entity := dt.Entity(customDeviceID); assert.NotNil(t, entity) {
+		assert.Equal(t, map[string]string{"team": "platform"}, entity.Tags)
+	}
+
+	// The cache was written and closed, it can be opened again
+	s, err = New(cfg)
+	assert.NoError(t, err)
+	assert.Len(t, s.tenants[0].problemCache.GetCache().Problems, 1)
+	assert.NoError(t, s.Close())
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/apiv2"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/cache"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dtclient"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dynatrace"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/jobs"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/queue"
+	"github.com/prometheus/alertmanager/template"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+// tenant is a Dynatrace environment, with its own client, caches, jobs and queue
+type tenant struct {
+	name      string
+	cfg       *config.Config
+	dt        dynatrace.Controller
+	scheduler jobs.Scheduler
+	// problemCache is only used by the admin API, the Controller and the Scheduler manage the problems
+	problemCache cache.ProblemStore
+	storage      cache.Storage
+	// dispatcher is nil if the queue is disabled, notifications are then sent before answering Alertmanager
+	dispatcher *queue.Dispatcher
+	apiV2      *apiv2.Client
+}
+
+// newTenant opens the caches and the queue of a tenant, cfg is the configuration returned by config.ForTenant
+func newTenant(name string, cfg *config.Config) (*tenant, error) {
+	t, err := openTenant(name, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Queue.Enabled {
+		q, err := queue.Open(cfg.Queue.Directory)
+		if err != nil {
+			_ = t.storage.Close()
+			return nil, err
+		}
+		t.dispatcher = queue.NewDispatcher(q, t.dt.SendAlerts, cfg.Queue.Workers, cfg.Queue.MaxRetries, cfg.Queue.RetryInterval)
+	}
+
+	return t, nil
+}
+
+// openTenant opens the caches of a tenant and builds its Controller, without the queue
+func openTenant(name string, cfg *config.Config) (*tenant, error) {
+	storage, err := cache.OpenStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+	customDeviceCache := cache.NewCustomDeviceCacheService(cfg, storage)
+	problemCache := cache.NewProblemCacheService(storage)
+	dtClient := dtclient.New(cfg)
+	scheduler := jobs.NewScheduler(cfg, dtClient, &customDeviceCache, &problemCache)
+
+	log.WithFields(log.Fields{"tenant": name, "apiURL": cfg.Dynatrace.APIURL}).Info("Will use API URL")
+
+	return &tenant{
+		name:         name,
+		cfg:          cfg,
+		dt:           dynatrace.NewDynatraceController(cfg, dtClient, &customDeviceCache, &problemCache, &scheduler),
+		scheduler:    scheduler,
+		problemCache: &problemCache,
+		storage:      storage,
+		apiV2:        apiv2.New(cfg),
+	}, nil
+}
+
+// checkName returns the name of a health check for this tenant, the tenant is omitted when it is the only one
+func (t *tenant) checkName(check string, single bool) string {
+	if single {
+		return check
+	}
+	return fmt.Sprintf("%s/%s", check, t.name)
+}
+
+// tenantFor returns the tenant of a notification, see tenantName
+func (s *Server) tenantFor(data alertmanager.Data, pathTenant string) (*tenant, error) {
+	name, err := tenantName(s.cfg, data, pathTenant)
+	if err != nil {
+		return nil, err
+	}
+	return s.tenantsByName[name], nil
+}
+
+// tenantName returns the name of the tenant of a notification, in order:
+// the tenant named in the /webhook/{tenant} path, the tenant listing the receiver of the notification,
+// the first tenant whose matchers match the common labels of the notification, and the default tenant
+func tenantName(cfg *config.Config, data alertmanager.Data, pathTenant string) (string, error) {
+	if pathTenant != "" {
+		for _, name := range cfg.TenantNames() {
+			if name == pathTenant {
+				return name, nil
+			}
+		}
+		return "", fmt.Errorf("unknown tenant %q", pathTenant)
+	}
+
+	// Without tenants in the configuration, everything goes to the dynatrace section
+	if len(cfg.Tenants) == 0 {
+		return config.DefaultTenantName, nil
+	}
+
+	for _, tenantConfig := range cfg.Tenants {
+		for _, receiver := range tenantConfig.Receivers {
+			if receiver == data.Receiver {
+				return tenantConfig.Name, nil
+			}
+		}
+	}
+	for _, tenantConfig := range cfg.Tenants {
+		if len(tenantConfig.Matchers) > 0 && tenantConfig.Matchers.Matches(data.CommonLabels) {
+			return tenantConfig.Name, nil
+		}
+	}
+	if cfg.DefaultTenant != "" {
+		return cfg.DefaultTenant, nil
+	}
+
+	return "", fmt.Errorf("the notification from the receiver %q with the labels %s does not match any tenant, and there is no defaultTenant", data.Receiver, formatLabels(data.CommonLabels))
+}
+
+func formatLabels(kv template.KV) string {
+	var labels []string
+	for _, pair := range kv.SortedPairs() {
+		labels = append(labels, fmt.Sprintf("%s=%q", pair.Name, pair.Value))
+	}
+	return "{" + strings.Join(labels, ", ") + "}"
+}
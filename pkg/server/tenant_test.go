@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/config"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/pkg/dtclient/fake"
+	"github.com/prometheus/alertmanager/template"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTenants(t *testing.T) {
+	prod, nonProd := fake.New("prod-token"), fake.New("non-prod-token")
+	defer prod.Close()
+	defer nonProd.Close()
+
+	matcher, _ := config.ParseMatcher(`env="prod"`)
+	cfg := config.Default()
+	cfg.Dynatrace.ProblemSeverities = []string{"critical"}
+	cfg.Dynatrace.Retries = 0
+	cfg.Cache.Directory = t.TempDir()
+	cfg.Tenants = []config.Tenant{
+		{Name: "prod", APIURL: prod.URL, APIToken: "prod-token", Matchers: config.Matchers{matcher}},
+		{Name: "non-prod", APIURL: nonProd.URL, APIToken: "non-prod-token", Receivers: []string{"dynatrace-non-prod"}},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	s, err := New(cfg)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	post := func(path string, data alertmanager.Data) int {
+		body, _ := json.Marshal(data)
+		recorder := httptest.NewRecorder()
+		s.webhook(recorder, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+		return recorder.Code
+	}
+	notification := func(receiver string, labels template.KV) alertmanager.Data {
+		return alertmanager.Data{
+			Receiver:     receiver,
+			Status:       "firing",
+			GroupKey:     receiver,
+			CommonLabels: labels,
+			Alerts:       template.Alerts{{Status: "firing", Labels: template.KV{"alertname": "Test", "severity": "critical"}}},
+		}
+	}
+
+	// By path, receiver and labels
+	assert.Equal(t, http.StatusOK, post("/webhook/non-prod", notification("dynatrace", nil)))
+	assert.Equal(t, http.StatusOK, post("/webhook", notification("dynatrace-non-prod", nil)))
+	assert.Equal(t, http.StatusOK, post("/webhook", notification("dynatrace", template.KV{"env": "prod"})))
+	assert.Len(t, nonProd.Events(), 2)
+	assert.Len(t, prod.Events(), 1)
+
+	// Each tenant has its own caches
+	assert.Len(t, s.tenantsByName["non-prod"].problemCache.GetCache().Problems, 2)
+	assert.Len(t, s.tenantsByName["prod"].problemCache.GetCache().Problems, 1)
+	_, err = os.Stat(filepath.Join(cfg.Cache.Directory, "prod", "problems.json"))
+	assert.NoError(t, err)
+
+	// Unroutable notifications are rejected, unless there is a default tenant
+	assert.Equal(t, http.StatusNotFound, post("/webhook/staging", notification("dynatrace", nil)))
+	assert.Equal(t, http.StatusNotFound, post("/webhook", notification("dynatrace", template.KV{"env": "dev"})))
+	cfg.DefaultTenant = "prod"
+	assert.Equal(t, http.StatusOK, post("/webhook", notification("dynatrace-dev", template.KV{"env": "dev"})))
+	assert.Len(t, prod.Events(), 2)
+
+	code, resp := checkHealth(t, s.readyz)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, resp.Checks, "dynatrace/prod")
+	assert.Contains(t, resp.Checks, "cache/non-prod")
+}
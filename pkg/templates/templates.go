@@ -0,0 +1,66 @@
+package templates
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
+	"github.com/prometheus/alertmanager/template"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Context is what the templates are executed against
+// The fields of the alert being processed are available directly (.Labels, .Annotations, .Status, .Fingerprint...)
+// and the whole Alertmanager notification is available as .Data (.Data.CommonLabels, .Data.Alerts...)
+type Context struct {
+	template.Alert
+	Data alertmanager.Data
+}
+
+// Template is a Go text/template with the Alertmanager template functions (toUpper, join, safeHtml...)
+type Template struct {
+	name string
+	tmpl *texttemplate.Template
+}
+
+// New parses text into a Template, returns nil if text is empty
+func New(name string, text string) (*Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := texttemplate.New(name).
+		Option("missingkey=zero").
+		Funcs(texttemplate.FuncMap(template.DefaultFuncs)).
+		Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the %s template: %s", name, err.Error())
+	}
+	return &Template{name: name, tmpl: tmpl}, nil
+}
+
+// Execute renders the template with the given context
+func (t *Template) Execute(ctx Context) (string, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, ctx); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// Render renders the template, falling back to the default value if the template is not set, fails or renders nothing
+func (t *Template) Render(ctx Context, fallback string) string {
+	if t == nil {
+		return fallback
+	}
+	rendered, err := t.Execute(ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"template": t.name, "error": err.Error(), "default": fallback}).Warning("Templates - Could not render the template, using the default value")
+		return fallback
+	}
+	if rendered == "" {
+		log.WithFields(log.Fields{"template": t.name, "default": fallback}).Warning("Templates - The template rendered an empty string, using the default value")
+		return fallback
+	}
+	return rendered
+}
@@ -0,0 +1,42 @@
+package templates
+
+import (
+	"github.com/dlopes7/dynatrace-alertmanager-receiver/alertmanager"
+	"github.com/prometheus/alertmanager/template"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	ctx := Context{
+		Alert: template.Alert{
+			Labels:      template.KV{"alertname": "TargetDown", "namespace": "kube-system"},
+			Annotations: template.KV{"message": "11.11% of the kubelet targets are down"},
+		},
+		Data: alertmanager.Data{ExternalURL: "http://alertmanager:9093"},
+	}
+
+	tmpl, err := New("title", `{{ .Labels.alertname | toUpper }} - {{ .Labels.namespace }}{{ .Labels.missing }}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "TARGETDOWN - kube-system", tmpl.Render(ctx, "default"))
+
+	tmpl, err = New("description", `{{ .Annotations.message }} ({{ .Data.ExternalURL }})`)
+	assert.NoError(t, err)
+	assert.Equal(t, "11.11% of the kubelet targets are down (http://alertmanager:9093)", tmpl.Render(ctx, "default"))
+
+	// Not set, failing and empty templates use the default value
+	tmpl, err = New("title", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "default", tmpl.Render(ctx, "default"))
+
+	tmpl, err = New("title", `{{ .Labels.alertname | reReplaceAll "(" "" }}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "default", tmpl.Render(ctx, "default"))
+
+	tmpl, err = New("title", `{{ .Labels.missing }}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "default", tmpl.Render(ctx, "default"))
+
+	_, err = New("title", `{{ .Labels.alertname `)
+	assert.Error(t, err)
+}